@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// audit actions recorded in product_audit.action
+const (
+	auditCreate   = "create"
+	auditUpdate   = "update"
+	auditDelete   = "delete"
+	auditRestore  = "restore"
+	auditPurchase = "purchase"
+	auditStock    = "stock"
+)
+
+// errProductMissing is wrapped, together with pgx.ErrNoRows, by
+// updateWithAudit when the product row itself does not exist.
+var errProductMissing = errors.New("product missing")
+
+// writeAudit records a product change inside tx, so it commits or rolls back
+// together with the change itself. old or new is nil when there is no such
+// state (create, delete).
+func writeAudit(ctx context.Context, tx pgx.Tx, productID, action string, old, new *Product) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO product_audit(product_id, action, old_value, new_value) VALUES($1::uuid, $2, $3, $4)`,
+		productID, action, old, new,
+	)
+	return err
+}
+
+// updateWithAudit locks product id, runs update (an UPDATE of products
+// without a RETURNING clause; the updated row is read back with
+// productColumns) and records the before/after images, all in one
+// transaction. pgx.ErrNoRows means the product is missing (then
+// errProductMissing is in the chain too) or the UPDATE's WHERE clause did not
+// match.
+func updateWithAudit(ctx context.Context, id, action, update string, args ...any) (Product, error) {
+	return updateWithAuditTx(ctx, id, action, nil, update, args...)
+}
+
+// updateWithAuditTx is updateWithAudit with an optional extra step, run in
+// the same transaction after the UPDATE and before the audit row is
+// written; it may amend the updated product. Once committed, a change that
+// takes stock below the low-stock threshold raises an alert.
+func updateWithAuditTx(ctx context.Context, id, action string, extra func(context.Context, pgx.Tx, *Product) error, update string, args ...any) (Product, error) {
+	var old, p Product
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		var err error
+		old, err = scanProduct(tx.QueryRow(ctx,
+			`SELECT `+productColumns+` FROM products`+productJoins+` WHERE id = $1::uuid FOR UPDATE OF products`, id,
+		))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %w", errProductMissing, err)
+		}
+		if err != nil {
+			return err
+		}
+		// the CTE is named products so productColumns/productJoins apply to
+		// the updated row; inside it, products is still the table
+		p, err = scanProduct(tx.QueryRow(ctx,
+			`WITH products AS (`+update+` RETURNING *) SELECT `+productColumns+` FROM products`+productJoins, args...,
+		))
+		if err != nil {
+			return err
+		}
+		if extra != nil {
+			if err := extra(ctx, tx, &p); err != nil {
+				return err
+			}
+		}
+		newVal := &p
+		if action == auditDelete {
+			newVal = nil
+		}
+		return writeAudit(ctx, tx, id, action, &old, newVal)
+	})
+	if err == nil {
+		checkLowStock(old, p)
+	}
+	return p, err
+}
+
+type auditEntry struct {
+	ID       int64           `json:"id"`
+	Action   string          `json:"action"`
+	OldValue json.RawMessage `json:"oldValue"`
+	NewValue json.RawMessage `json:"newValue"`
+	At       string          `json:"at"`
+}
+
+// getProductHistory serves GET /products/:id/history, newest first. It
+// includes soft-deleted products so their trail stays reachable.
+func getProductHistory(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	rows, err := db.Query(ctx,
+		`SELECT id, action, old_value, new_value, at FROM product_audit
+		 WHERE product_id = $1::uuid ORDER BY at DESC, id DESC`, id,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (auditEntry, error) {
+		var e auditEntry
+		var at time.Time
+		err := row.Scan(&e.ID, &e.Action, &e.OldValue, &e.NewValue, &at)
+		e.At = at.Format(time.RFC3339)
+		return e, err
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	if len(entries) == 0 {
+		var exists bool
+		if err := db.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM products WHERE id = $1::uuid)`, id).Scan(&exists); err != nil {
+			writeDBError(w, err, "db error")
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+type pricePoint struct {
+	PriceCents int    `json:"priceCents"`
+	Currency   string `json:"currency"`
+	ChangedAt  string `json:"changedAt"`
+}
+
+// getPriceHistory serves GET /products/:id/price-history, oldest first. The
+// products_price_history trigger fills it on every insert and price change.
+func getPriceHistory(w http.ResponseWriter, r *http.Request, id string) {
+	rows, err := db.Query(r.Context(),
+		`SELECT price_cents, currency, changed_at FROM price_history
+		 WHERE product_id = $1::uuid ORDER BY changed_at, id`, id,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	points, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (pricePoint, error) {
+		var p pricePoint
+		var at time.Time
+		err := row.Scan(&p.PriceCents, &p.Currency, &at)
+		p.ChangedAt = at.Format(time.RFC3339)
+		return p, err
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	// every product has at least its initial price
+	if len(points) == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, points)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxBatchIDs caps the ids per GET /products/batch.
+const maxBatchIDs = 100
+
+// getProductsBatch serves GET /products/batch?ids=a,b,c. Found products come
+// back in the order asked for; ids that are unknown or deleted are listed
+// under missing. Repeated ids are looked up once.
+func getProductsBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var ids []string
+	for _, s := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := uuid.Parse(s)
+		if err != nil {
+			writeFieldErrors(w, fieldErrors{"ids": strconv.Quote(s) + " is not a UUID"})
+			return
+		}
+		// canonical, so it compares equal to the ids read back
+		id := u.String()
+		if slices.Contains(ids, id) {
+			continue
+		}
+		if ids = append(ids, id); len(ids) > maxBatchIDs {
+			break
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxBatchIDs {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "expected 1 to "+strconv.Itoa(maxBatchIDs)+" ids")
+		return
+	}
+
+	rows, err := db.Query(r.Context(),
+		`SELECT `+productColumns+` FROM products`+productJoins+` WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL`, ids,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Product, error) { return scanProduct(row) })
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	byID := make(map[string]Product, len(found))
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+	items := make([]Product, 0, len(found))
+	missing := []string{}
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			items = append(items, p)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": items, "missing": missing})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxBulkItems caps the number of products per POST /products/bulk.
+const maxBulkItems = 1000
+
+// bulkResult reports the outcome of one item of a bulk request.
+type bulkResult struct {
+	Index   int         `json:"index"`
+	Status  int         `json:"status"`
+	Product *Product    `json:"product,omitempty"`
+	Errors  fieldErrors `json:"errors,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// bulkCreateProducts serves POST /products/bulk. With ?mode=atomic (the
+// default) all items are inserted in one transaction or none are; with
+// ?mode=partial each item succeeds or fails on its own and the response is
+// 207 with a result per item. The cache is invalidated once per request.
+func bulkCreateProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "atomic"
+	}
+	if mode != "atomic" && mode != "partial" {
+		writeError(w, http.StatusBadRequest, codeBadRequest, `mode must be "atomic" or "partial"`)
+		return
+	}
+
+	var items []createBody
+	if !decodeBody(w, r, &items) {
+		return
+	}
+	if len(items) == 0 || len(items) > maxBulkItems {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "expected 1 to "+strconv.Itoa(maxBulkItems)+" items")
+		return
+	}
+
+	results := make([]bulkResult, len(items))
+	invalid := false
+	for i := range items {
+		results[i].Index = i
+		if errs := items[i].validate(); len(errs) > 0 {
+			results[i].Status = http.StatusBadRequest
+			results[i].Errors = errs
+			invalid = true
+		}
+	}
+
+	// markUnknown fails the still-valid items whose category isn't in
+	// categories, reporting whether there were any
+	markUnknown := func(categories map[string]string) bool {
+		found := false
+		for i, it := range items {
+			if results[i].Status == 0 && it.CategoryID != nil && categories[*it.CategoryID] == "" {
+				results[i].Status = http.StatusBadRequest
+				results[i].Errors = fieldErrors{"categoryId": "unknown category"}
+				found = true
+			}
+		}
+		return found
+	}
+	categories, err := categoryNames(ctx, db, items)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if markUnknown(categories) {
+		invalid = true
+	}
+
+	if mode == "atomic" {
+		if invalid {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"results": results})
+			return
+		}
+		list, err := insertProductsBatch(ctx, items, categories)
+		if isUniqueViolation(err) {
+			writeError(w, http.StatusConflict, codeConflict, "one of these products clashes with an existing name or SKU")
+			return
+		}
+		if isForeignKeyViolation(err) {
+			// a category was deleted since it was looked up; say which
+			if categories, err := categoryNames(ctx, db, items); err == nil && markUnknown(categories) {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"results": results})
+			} else {
+				writeFieldErrors(w, fieldErrors{"categoryId": "unknown category"})
+			}
+			return
+		}
+		if err != nil {
+			writeDBError(w, err, "insert error")
+			return
+		}
+		ids := make([]string, len(list))
+		for i, p := range list {
+			ids[i] = p.ID
+		}
+		invalidateProducts(ctx, eventCreated, ids...)
+		writeJSON(w, http.StatusCreated, map[string]any{"items": list})
+		return
+	}
+
+	// partial: one savepoint per item so a failing row doesn't abort the rest
+	var inserted []string
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		for i, it := range items {
+			if results[i].Status != 0 {
+				continue
+			}
+			sp, err := tx.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			p, err := insertProduct(ctx, sp, it)
+			if err != nil {
+				if rbErr := sp.Rollback(ctx); rbErr != nil {
+					return rbErr
+				}
+				switch {
+				case isUniqueViolation(err):
+					results[i].Status = http.StatusConflict
+					results[i].Error = productConflict(err)
+				case isForeignKeyViolation(err):
+					// the category was deleted since it was looked up
+					results[i].Status = http.StatusBadRequest
+					results[i].Errors = fieldErrors{"categoryId": "unknown category"}
+				default:
+					results[i].Status = http.StatusInternalServerError
+					results[i].Error = "insert error"
+				}
+				continue
+			}
+			if err := sp.Commit(ctx); err != nil {
+				return err
+			}
+			results[i].Status = http.StatusCreated
+			results[i].Product = &p
+			inserted = append(inserted, p.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if len(inserted) > 0 {
+		invalidateProducts(ctx, eventCreated, inserted...)
+	}
+	writeJSON(w, http.StatusMultiStatus, map[string]any{"results": results})
+}
+
+// insertProductsBatch inserts validated items and their audit rows in a
+// single transaction, sent to Postgres as one pgx.Batch. categories is the
+// categoryNames of items.
+func insertProductsBatch(ctx context.Context, items []createBody, categories map[string]string) ([]Product, error) {
+	list := make([]Product, len(items))
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		b := &pgx.Batch{}
+		for i, it := range items {
+			p := newProduct(it, categories)
+			list[i] = p
+			b.Queue(insertProductSQL, insertArgs(p)...)
+			if len(p.Tags) > 0 {
+				b.Queue(upsertTagsSQL, p.Tags)
+				b.Queue(linkTagsSQL, p.ID, p.Tags)
+			}
+			b.Queue(`INSERT INTO product_audit(product_id, action, new_value) VALUES($1::uuid, $2, $3)`,
+				p.ID, auditCreate, &list[i])
+		}
+		return tx.SendBatch(ctx, b).Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// deleteProducts serves DELETE /products: it soft-deletes every live product
+// matching the list filters, which are mandatory so a bare DELETE can't wipe
+// the catalogue. Each product gets its own audit row.
+func deleteProducts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	lp, err := parseListParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if !lp.filtered() {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "refusing to delete all products; add a filter")
+		return
+	}
+
+	var ids []string
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		var sw sqlWhere
+		lp.applyFilters(&sw)
+		rows, err := tx.Query(ctx,
+			`SELECT `+productColumns+` FROM products`+productJoins+sw.String()+` FOR UPDATE OF products`, sw.args...,
+		)
+		if err != nil {
+			return err
+		}
+		old, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Product, error) { return scanProduct(row) })
+		if err != nil || len(old) == 0 {
+			return err
+		}
+		ids = make([]string, len(old))
+		for i, p := range old {
+			ids[i] = p.ID
+		}
+		b := &pgx.Batch{}
+		b.Queue(`UPDATE products SET deleted_at = now(), version = version + 1, updated_at = now() WHERE id = ANY($1::uuid[])`, ids)
+		for i := range old {
+			b.Queue(`INSERT INTO product_audit(product_id, action, old_value) VALUES($1::uuid, $2, $3)`,
+				old[i].ID, auditDelete, &old[i])
+		}
+		return tx.SendBatch(ctx, b).Close()
+	})
+	if err != nil {
+		writeDBError(w, err, "delete error")
+		return
+	}
+	if len(ids) > 0 {
+		invalidateProducts(ctx, eventDeleted, ids...)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": len(ids)})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- circuit breaker ---
+
+// breaker stops calls to a failing dependency for a cooldown period after
+// threshold consecutive failures. It is safe for concurrent use.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may be attempted. After the cooldown calls
+// resume, but the failure count is kept until a success, so a single further
+// failure reopens the breaker.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		slog.Warn("redis breaker open", "cooldown", b.cooldown, "failures", b.failures)
+	}
+}
+
+// redisBreaker guards every cache call; main replaces it with the env config.
+var redisBreaker = newBreaker(5, 30*time.Second)
+
+// --- cache access ---
+
+// localCache sits in front of Redis to save the round-trip on hot keys
+// (LOCAL_CACHE_SIZE, LOCAL_CACHE_TTL); nil when disabled. Its short TTL
+// bounds staleness if an invalidation notice is missed.
+var localCache *lruCache
+
+// cacheGet returns the cached value for key, from localCache or Redis.
+// Misses, errors and an open breaker all report ok=false so callers fall
+// through to the database.
+func cacheGet(ctx context.Context, key string) (string, bool) {
+	if localCache != nil {
+		if s, ok := localCache.get(key); ok {
+			slog.DebugContext(ctx, "cache hit", "key", key, "tier", "local")
+			return s, true
+		}
+	}
+	s, ok := redisGet(ctx, key)
+	if ok && localCache != nil {
+		// the Redis TTL left is unknown here; the local TTL is the bound
+		localCache.set(key, s, localCache.ttl)
+	}
+	return s, ok
+}
+
+// redisGet is cacheGet's Redis tier.
+func redisGet(ctx context.Context, key string) (string, bool) {
+	if rdb == nil || !redisBreaker.allow() {
+		return "", false
+	}
+	s, err := rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		redisBreaker.success()
+		slog.DebugContext(ctx, "cache miss", "key", key)
+		return "", false
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "redis get failed", "key", key, "err", err)
+		redisBreaker.failure()
+		return "", false
+	}
+	redisBreaker.success()
+	slog.DebugContext(ctx, "cache hit", "key", key, "tier", "redis")
+	return s, s != ""
+}
+
+// cacheSet stores b under key, locally and in Redis. It returns an error
+// only when a Redis write was attempted and failed; a disabled cache or open
+// breaker is not an error.
+func cacheSet(ctx context.Context, key string, b []byte, ttl time.Duration) error {
+	if localCache != nil {
+		localCache.set(key, string(b), ttl)
+	}
+	return redisSet(ctx, key, b, ttl)
+}
+
+// redisSet is cacheSet's Redis tier.
+func redisSet(ctx context.Context, key string, b []byte, ttl time.Duration) error {
+	if rdb == nil || !redisBreaker.allow() {
+		return nil
+	}
+	if err := rdb.Set(ctx, key, b, ttl).Err(); err != nil {
+		slog.WarnContext(ctx, "redis set failed", "key", key, "err", err)
+		redisBreaker.failure()
+		return err
+	}
+	redisBreaker.success()
+	return nil
+}
+
+// invalidateProducts drops every cached product list after the products ids
+// had a change of type event.
+func invalidateProducts(ctx context.Context, event string, ids ...string) {
+	invalidate(ctx, productChange{Type: event, IDs: ids})
+}
+
+// invalidateProduct is invalidateProducts for products whose new state is
+// known, so listeners get their stock too.
+func invalidateProduct(ctx context.Context, event string, ps ...Product) {
+	c := productChange{Type: event, Stock: make(map[string]int, len(ps))}
+	for _, p := range ps {
+		c.IDs = append(c.IDs, p.ID)
+		c.Stock[p.ID] = p.Stock
+	}
+	invalidate(ctx, c)
+}
+
+// listVersionKey holds the generation of the cached lists, counts and
+// stats. Their Redis keys embed it (see listCacheKey), so bumping it orphans every one
+// of them at once, however many variants are cached; the orphans expire with
+// their TTL.
+const listVersionKey = "products:version"
+
+// listCacheKey names a cached list-derived response. In localCache it is
+// keyed by suffix alone, since invalidation clears the local caches; epoch
+// is the clear count when the key was taken, so a result that raced one
+// isn't stored locally. In Redis it sits under the current generation,
+// looked up only once the local tier misses; remote is "" when Redis was
+// skipped. Both are taken before querying, so a result that raced a write
+// lands under the old generation, where nobody reads it.
+type listCacheKey struct {
+	local  string
+	remote string
+	epoch  uint64
+}
+
+// String identifies the entry, generation included, for singleflight keys
+// and logs.
+func (k listCacheKey) String() string {
+	if k.remote != "" {
+		return k.remote
+	}
+	return k.local + "@" + strconv.FormatUint(k.epoch, 10)
+}
+
+// localEpoch counts clearLocalCaches calls.
+var localEpoch atomic.Uint64
+
+// listCacheGet looks up the list-derived response suffix, from localCache
+// and then Redis, returning the key listCacheSet stores a miss under.
+func listCacheGet(ctx context.Context, suffix string) (string, listCacheKey, bool) {
+	k := listCacheKey{local: "products:list:" + suffix, epoch: localEpoch.Load()}
+	if localCache != nil {
+		if s, ok := localCache.get(k.local); ok {
+			slog.DebugContext(ctx, "cache hit", "key", k.local, "tier", "local")
+			return s, k, true
+		}
+	}
+	if rdb == nil || !redisBreaker.allow() {
+		return "", k, false
+	}
+	k.remote = "products:list:v" + listVersion(ctx) + ":" + suffix
+	s, ok := redisGet(ctx, k.remote)
+	if ok && localCache != nil && localEpoch.Load() == k.epoch {
+		localCache.set(k.local, s, localCache.ttl)
+	}
+	return s, k, ok
+}
+
+// listCacheSet is cacheSet for a listCacheKey.
+func listCacheSet(ctx context.Context, k listCacheKey, b []byte, ttl time.Duration) error {
+	if localCache != nil && localEpoch.Load() == k.epoch {
+		localCache.set(k.local, string(b), ttl)
+	}
+	if k.remote == "" {
+		return nil
+	}
+	return redisSet(ctx, k.remote, b, ttl)
+}
+
+func listVersion(ctx context.Context) string {
+	if rdb == nil || !redisBreaker.allow() {
+		return "0"
+	}
+	v, err := rdb.Get(ctx, listVersionKey).Result()
+	if errors.Is(err, redis.Nil) {
+		redisBreaker.success()
+		return "0"
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "redis get failed", "key", listVersionKey, "err", err)
+		redisBreaker.failure()
+		return "0"
+	}
+	redisBreaker.success()
+	return v
+}
+
+// invalidate drops every cached product list by bumping listVersionKey.
+// Local caches and event streams are updated right away and the other
+// instances are told through invalidateChannel.
+func invalidate(ctx context.Context, c productChange) {
+	clearLocalCaches()
+	changes.publish(c)
+	if rdb == nil || !redisBreaker.allow() {
+		return
+	}
+	defer publishInvalidation(ctx, c)
+	if err := rdb.Incr(ctx, listVersionKey).Err(); err != nil {
+		slog.WarnContext(ctx, "redis incr failed", "key", listVersionKey, "err", err)
+		redisBreaker.failure()
+		return
+	}
+	redisBreaker.success()
+}
+
+// --- cross-instance invalidation ---
+
+// invalidateChannel carries "product data changed" notices between
+// instances, each of which then clears its in-process caches and tells its
+// SSE streams.
+const invalidateChannel = "products:invalidate"
+
+// instanceID tells this instance's own notices apart from the others'.
+var instanceID = uuid.NewString()
+
+// invalidation is a message on invalidateChannel.
+type invalidation struct {
+	Instance string `json:"instance"`
+	productChange
+}
+
+var (
+	localCachesMu sync.Mutex
+	localCaches   []func()
+)
+
+// registerLocalCache adds the clear func of an in-process cache, run on
+// every invalidation from this or another instance.
+func registerLocalCache(clear func()) {
+	localCachesMu.Lock()
+	defer localCachesMu.Unlock()
+	localCaches = append(localCaches, clear)
+}
+
+func clearLocalCaches() {
+	localCachesMu.Lock()
+	defer localCachesMu.Unlock()
+	localEpoch.Add(1)
+	for _, clear := range localCaches {
+		clear()
+	}
+}
+
+func publishInvalidation(ctx context.Context, c productChange) {
+	msg, _ := json.Marshal(invalidation{Instance: instanceID, productChange: c})
+	if err := rdb.Publish(ctx, invalidateChannel, msg).Err(); err != nil {
+		slog.WarnContext(ctx, "redis publish failed", "channel", invalidateChannel, "err", err)
+	}
+}
+
+// subscribeInvalidations clears the local caches and forwards the change to
+// SSE streams whenever another instance publishes to invalidateChannel,
+// until ctx is done. go-redis resubscribes after a dropped connection;
+// notices sent meanwhile are lost, so local caches must also expire on
+// their own.
+func subscribeInvalidations(ctx context.Context) {
+	sub := rdb.Subscribe(ctx, invalidateChannel)
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				var inv invalidation
+				if err := json.Unmarshal([]byte(m.Payload), &inv); err != nil {
+					// not from this version; still a change notice
+					clearLocalCaches()
+					continue
+				}
+				if inv.Instance == instanceID {
+					continue // handled when it was published
+				}
+				clearLocalCaches()
+				changes.publish(inv.productChange)
+			}
+		}
+	}()
+}
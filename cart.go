@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// cartTTL is how long an untouched cart lives (CART_TTL); every add
+// restarts it.
+var cartTTL = 24 * time.Hour
+
+// A cart is the Redis hash cart:<id> mapping product ids to quantities,
+// plus a created_at field so an empty cart still exists.
+const cartCreatedField = "created_at"
+
+func cartKey(id string) string { return "cart:" + id }
+
+// cartItem is a cart line priced at the product's current effective price.
+type cartItem struct {
+	ProductID      string `json:"productId"`
+	Name           string `json:"name"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int    `json:"unitPriceCents"`
+	LineTotalCents int    `json:"lineTotalCents"`
+	Currency       string `json:"currency"`
+}
+
+// Cart is the GET /carts/:id response. Totals sums the lines per currency.
+// Unavailable lists products added earlier that have since been deleted;
+// they don't count towards the totals.
+type Cart struct {
+	ID          string         `json:"id"`
+	Items       []cartItem     `json:"items"`
+	Totals      map[string]int `json:"totals"`
+	Unavailable []string       `json:"unavailable"`
+	CreatedAt   string         `json:"created_at"`
+	ExpiresAt   string         `json:"expiresAt"`
+}
+
+// cartAddScript adds ARGV[2] of product ARGV[1] to an existing cart unless
+// the line would exceed ARGV[3] in stock, and restarts the TTL (ARGV[4] ms).
+// It returns the new quantity, -1 if the cart doesn't exist or -2 if stock
+// is short. Running it as one script keeps concurrent adds from
+// overshooting the stock between the check and the increment.
+var cartAddScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return -1 end
+local have = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local want = have + tonumber(ARGV[2])
+if want > tonumber(ARGV[3]) then return -2 end
+redis.call('HSET', KEYS[1], ARGV[1], want)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return want
+`)
+
+// requireRedis answers 503 when Redis isn't configured; carts have no other
+// store.
+func requireRedis(w http.ResponseWriter) bool {
+	if rdb == nil {
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "carts are unavailable: Redis is not configured")
+		return false
+	}
+	return true
+}
+
+// writeRedisError answers a failed cart call.
+func writeRedisError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, codeTimeout, "redis timeout")
+		return
+	}
+	writeError(w, http.StatusServiceUnavailable, codeUnavailable, "redis error")
+}
+
+// cartsHandler serves POST /carts, which starts an empty cart.
+func cartsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !requireRedis(w) {
+		return
+	}
+	id := uuid.NewString()
+	now := time.Now().UTC()
+	_, err := rdb.TxPipelined(r.Context(), func(p redis.Pipeliner) error {
+		p.HSet(r.Context(), cartKey(id), cartCreatedField, now.Format(time.RFC3339))
+		p.Expire(r.Context(), cartKey(id), cartTTL)
+		return nil
+	})
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/carts/"+id)
+	writeJSON(w, http.StatusCreated, Cart{
+		ID:          id,
+		Items:       []cartItem{},
+		Totals:      map[string]int{},
+		Unavailable: []string{},
+		CreatedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(cartTTL).Format(time.RFC3339),
+	})
+}
+
+// cartItemHandler routes /carts/:id and /carts/:id/items.
+func cartItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/carts/"), "/")
+	if uuid.Validate(id) != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "cart not found")
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		if requireRedis(w) {
+			getCart(w, r, id)
+		}
+	case sub == "items" && r.Method == http.MethodPost:
+		if requireRedis(w) {
+			addCartItem(w, r, id)
+		}
+	case sub == "" || sub == "items":
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	default:
+		notFound(w, r)
+	}
+}
+
+type cartItemBody struct {
+	ProductID string `json:"productId"`
+	Quantity  int    `json:"quantity"`
+}
+
+func (b *cartItemBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	if u, err := uuid.Parse(b.ProductID); err != nil {
+		errs["productId"] = "must be a UUID"
+	} else {
+		b.ProductID = u.String()
+	}
+	if b.Quantity <= 0 || b.Quantity > maxQuantity {
+		errs["quantity"] = quantityInvalid
+	}
+	return errs
+}
+
+// addCartItem adds a quantity of a product to the cart, on top of any
+// already there. The product must exist and have available stock for the
+// whole line; stock is only checked, not held.
+func addCartItem(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var body cartItemBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	var stock int
+	err := db.QueryRow(ctx, `SELECT `+availableStockExpr+` FROM products WHERE id = $1::uuid AND deleted_at IS NULL`, body.ProductID).Scan(&stock)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeFieldErrors(w, fieldErrors{"productId": "product not found"})
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	n, err := cartAddScript.Run(ctx, rdb, []string{cartKey(id)},
+		body.ProductID, body.Quantity, stock, cartTTL.Milliseconds()).Int()
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	switch n {
+	case -1:
+		writeError(w, http.StatusNotFound, codeNotFound, "cart not found")
+		return
+	case -2:
+		writeError(w, http.StatusConflict, codeInsufficientStock, "insufficient stock: "+strconv.Itoa(stock)+" available")
+		return
+	}
+	getCart(w, r, id)
+}
+
+// getCart writes the cart with every line priced from the database.
+func getCart(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var fields *redis.MapStringStringCmd
+	var ttl *redis.DurationCmd
+	_, err := rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		fields = p.HGetAll(ctx, cartKey(id))
+		ttl = p.PTTL(ctx, cartKey(id))
+		return nil
+	})
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	if len(fields.Val()) == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "cart not found")
+		return
+	}
+
+	c := Cart{
+		ID:          id,
+		Items:       []cartItem{},
+		Totals:      map[string]int{},
+		Unavailable: []string{},
+		CreatedAt:   fields.Val()[cartCreatedField],
+		ExpiresAt:   time.Now().Add(ttl.Val()).UTC().Format(time.RFC3339),
+	}
+	quantities := map[string]int{}
+	var ids []string
+	for f, v := range fields.Val() {
+		if f == cartCreatedField {
+			continue
+		}
+		q, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		quantities[f] = q
+		ids = append(ids, f)
+	}
+	slices.Sort(ids)
+	if len(ids) == 0 {
+		writeJSON(w, http.StatusOK, c)
+		return
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT `+productColumns+` FROM products`+productJoins+` WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL ORDER BY name, id`, ids,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	products, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Product, error) { return scanProduct(row) })
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	for _, p := range products {
+		q := quantities[p.ID]
+		delete(quantities, p.ID)
+		// overflows fail like they do at checkout, which prices lines the same way
+		line, ok := lineTotal(p.EffectivePriceCents, q)
+		if !ok || c.Totals[p.Currency] > math.MaxInt-line {
+			writeAPIError(w, http.StatusBadRequest, apiError{Code: codeValidation, Message: "makes the cart total too large", ProductID: p.ID})
+			return
+		}
+		c.Items = append(c.Items, cartItem{
+			ProductID:      p.ID,
+			Name:           p.Name,
+			Quantity:       q,
+			UnitPriceCents: p.EffectivePriceCents,
+			LineTotalCents: line,
+			Currency:       p.Currency,
+		})
+		c.Totals[p.Currency] += line
+	}
+	for _, pid := range ids {
+		if _, gone := quantities[pid]; gone {
+			c.Unavailable = append(c.Unavailable, pid)
+		}
+	}
+	writeJSON(w, http.StatusOK, c)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type Category struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+}
+
+// errUnknownCategory is returned by insertProduct when the body references a
+// category that does not exist.
+var errUnknownCategory = errors.New("unknown category")
+
+// categoriesHandler serves GET and POST /categories.
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listCategories(w, r)
+	case http.MethodPost:
+		createCategory(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func listCategories(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(r.Context(), `SELECT id, name, created_at FROM categories ORDER BY name, id`)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Category, error) {
+		var c Category
+		var t time.Time
+		err := row.Scan(&c.ID, &c.Name, &t)
+		c.CreatedAt = t.Format(time.RFC3339)
+		return c, err
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type categoryBody struct {
+	Name string `json:"name"`
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	var body categoryBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeFieldErrors(w, fieldErrors{"name": "required"})
+		return
+	}
+
+	createdAt := time.Now().UTC()
+	c := Category{ID: uuid.New().String(), Name: body.Name, CreatedAt: createdAt.Format(time.RFC3339)}
+	_, err := db.Exec(r.Context(),
+		`INSERT INTO categories(id, name, created_at) VALUES($1, $2, $3)`, c.ID, c.Name, createdAt,
+	)
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, codeConflict, "a category with this name already exists")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "insert error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// querier is the part of *pgxpool.Pool and pgx.Tx that read helpers need.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// categoryNames resolves the categoryIds referenced by items to their names.
+// Unknown ids, and ones that are not even UUIDs, are simply absent from the
+// result.
+func categoryNames(ctx context.Context, q querier, items []createBody) (map[string]string, error) {
+	var ids []string
+	for _, it := range items {
+		if it.CategoryID != nil && uuid.Validate(*it.CategoryID) == nil {
+			ids = append(ids, *it.CategoryID)
+		}
+	}
+	names := map[string]string{}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	rows, err := q.Query(ctx, `SELECT id, name FROM categories WHERE id = ANY($1::uuid[])`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
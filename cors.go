@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig is the CORS policy applied by withCORS.
+type corsConfig struct {
+	origins     map[string]bool // ALLOWED_ORIGINS; nil allows any origin
+	maxAge      time.Duration   // CORS_MAX_AGE, how long preflights are cached; 0 omits it
+	methods     string          // CORS_ALLOWED_METHODS
+	headers     string          // CORS_ALLOWED_HEADERS
+	credentials bool            // CORS_ALLOW_CREDENTIALS; needs an origin allowlist
+	// routes narrows the methods to those of the requested route; nil
+	// keeps methods for every path
+	routes *routeMethods
+}
+
+// defaults for CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS: everything the
+// API uses, including the auth headers
+const (
+	defaultCORSMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	defaultCORSHeaders = "Authorization, Content-Type, Idempotency-Key, If-Match, If-Modified-Since, If-None-Match, X-API-Key, X-Dry-Run, X-Request-ID"
+)
+
+// corsList normalizes a comma-separated env list for a header value,
+// falling back to def when s is empty.
+func corsList(s, def string) string {
+	var parts []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return def
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseOrigins parses the comma-separated ALLOWED_ORIGINS. It returns nil,
+// meaning any origin, when the list is empty.
+func parseOrigins(s string) map[string]bool {
+	var origins map[string]bool
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if origins == nil {
+			origins = map[string]bool{}
+		}
+		origins[o] = true
+	}
+	return origins
+}
+
+// withCORS adds the CORS headers and answers preflights. With an allowlist
+// the request Origin is echoed back only if it is listed; other origins get
+// no Access-Control-Allow-Origin and so are refused by the browser.
+// Credentials are only ever allowed alongside a specific origin, as browsers
+// reject them with "*".
+//
+// On documented routes the allowed methods are the route's own, within
+// cfg.methods, and Allow lists them on preflights and on requests whose
+// method the route doesn't serve, which its handler answers with 405.
+func withCORS(cfg corsConfig, next http.Handler) http.Handler {
+	permitted := map[string]bool{}
+	for _, m := range strings.Split(cfg.methods, ",") {
+		permitted[strings.TrimSpace(m)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if cfg.origins == nil {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// the response differs per origin, so shared caches must key on it
+			h.Add("Vary", "Origin")
+			if o := r.Header.Get("Origin"); cfg.origins[o] {
+				h.Set("Access-Control-Allow-Origin", o)
+				if cfg.credentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+		}
+		methods := cfg.methods
+		if route := cfg.routes.lookup(r.URL.Path); route != nil {
+			allow := strings.Join(route, ", ")
+			if r.Method == http.MethodOptions || !slices.Contains(route, r.Method) {
+				h.Set("Allow", allow)
+			}
+			var cors []string
+			for _, m := range route {
+				if permitted[m] {
+					cors = append(cors, m)
+				}
+			}
+			methods = strings.Join(cors, ", ")
+		}
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", cfg.headers)
+		h.Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Last-Modified, X-Request-ID")
+		if r.Method == http.MethodOptions {
+			if cfg.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Coupon is a promo code worth either PercentOff of the order or
+// AmountOffCents off it, never both. Null ExpiresAt or MaxUses means no
+// limit.
+type Coupon struct {
+	Code           string  `json:"code"`
+	PercentOff     *int    `json:"percentOff"`
+	AmountOffCents *int    `json:"amountOffCents"`
+	ExpiresAt      *string `json:"expiresAt"`
+	MaxUses        *int    `json:"maxUses"`
+	UsedCount      int     `json:"usedCount"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+const couponColumns = "code, percent_off, amount_off_cents, expires_at, max_uses, used_count, created_at"
+
+func scanCoupon(row pgx.Row) (Coupon, error) {
+	var c Coupon
+	var expires *time.Time
+	var created time.Time
+	if err := row.Scan(&c.Code, &c.PercentOff, &c.AmountOffCents, &expires, &c.MaxUses, &c.UsedCount, &created); err != nil {
+		return Coupon{}, err
+	}
+	c.ExpiresAt = formatOptionalTime(expires)
+	c.CreatedAt = created.Format(time.RFC3339)
+	return c, nil
+}
+
+// couponPattern is what codes may look like; they are stored upper-cased so
+// lookups are case-insensitive.
+var couponPattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+func normalizeCouponCode(s string) string {
+	return strings.ToUpper(strings.TrimSpace(s))
+}
+
+// discount is what c takes off an order of amountCents, never more than the
+// order itself.
+func (c Coupon) discount(amountCents int) int {
+	if c.PercentOff != nil {
+		return amountCents * *c.PercentOff / 100
+	}
+	return min(*c.AmountOffCents, amountCents)
+}
+
+// unusable says why c can't be applied at now, or "" if it can.
+func (c Coupon) unusable(now time.Time) string {
+	if c.ExpiresAt != nil {
+		if t, err := time.Parse(time.RFC3339, *c.ExpiresAt); err == nil && !now.Before(t) {
+			return "coupon has expired"
+		}
+	}
+	if c.MaxUses != nil && c.UsedCount >= *c.MaxUses {
+		return "coupon has been used up"
+	}
+	return ""
+}
+
+type newCouponBody struct {
+	Code           string  `json:"code"`
+	PercentOff     *int    `json:"percentOff"`
+	AmountOffCents *int    `json:"amountOffCents"`
+	ExpiresAt      *string `json:"expiresAt"` // RFC 3339
+	MaxUses        *int    `json:"maxUses"`
+}
+
+// couponsHandler serves POST /coupons.
+func couponsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body newCouponBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	errs := fieldErrors{}
+	body.Code = normalizeCouponCode(body.Code)
+	if !couponPattern.MatchString(body.Code) {
+		errs["code"] = "must be 3 to 32 letters, digits, dashes or underscores"
+	}
+	switch {
+	case (body.PercentOff == nil) == (body.AmountOffCents == nil):
+		errs["percentOff"] = "exactly one of percentOff and amountOffCents is required"
+	case body.PercentOff != nil && (*body.PercentOff < 1 || *body.PercentOff > 100):
+		errs["percentOff"] = "must be between 1 and 100"
+	case body.AmountOffCents != nil && *body.AmountOffCents <= 0:
+		errs["amountOffCents"] = "must be > 0"
+	}
+	if body.ExpiresAt != nil {
+		if s, ok := normalizeTimestamp(*body.ExpiresAt); ok {
+			body.ExpiresAt = &s
+		} else {
+			errs["expiresAt"] = timestampInvalid
+		}
+	}
+	if body.MaxUses != nil && *body.MaxUses <= 0 {
+		errs["maxUses"] = "must be > 0"
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	c, err := scanCoupon(db.QueryRow(r.Context(),
+		`INSERT INTO coupons(code, percent_off, amount_off_cents, expires_at, max_uses) VALUES($1, $2, $3, $4, $5)
+		 RETURNING `+couponColumns,
+		body.Code, body.PercentOff, body.AmountOffCents, body.ExpiresAt, body.MaxUses,
+	))
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, codeConflict, "a coupon with this code already exists")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "insert error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// maxCouponAmountCents caps amountCents so a percent discount, which
+// multiplies it by up to 100, can't overflow.
+const maxCouponAmountCents = math.MaxInt / 100
+
+var couponAmountInvalid = fmt.Sprintf("must be between 1 and %d", maxCouponAmountCents)
+
+// couponBody is the request of /coupons/validate and /coupons/redeem:
+// the code and the order total it is to be applied to.
+type couponBody struct {
+	Code        string `json:"code"`
+	AmountCents int    `json:"amountCents"`
+}
+
+func (b *couponBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	b.Code = normalizeCouponCode(b.Code)
+	if b.Code == "" {
+		errs["code"] = "required"
+	}
+	if b.AmountCents <= 0 || b.AmountCents > maxCouponAmountCents {
+		errs["amountCents"] = couponAmountInvalid
+	}
+	return errs
+}
+
+// couponResult is the response of both endpoints.
+type couponResult struct {
+	Code          string `json:"code"`
+	DiscountCents int    `json:"discountCents"`
+	TotalCents    int    `json:"totalCents"` // amountCents less the discount
+	Coupon        Coupon `json:"coupon"`
+}
+
+func writeCouponResult(w http.ResponseWriter, c Coupon, amountCents int) {
+	d := c.discount(amountCents)
+	writeJSON(w, http.StatusOK, couponResult{Code: c.Code, DiscountCents: d, TotalCents: amountCents - d, Coupon: c})
+}
+
+// validateCoupon serves POST /coupons/validate: it reports the discount the
+// code would give without using it up. 404 means no such code, 409 that it
+// has expired or run out.
+func validateCoupon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body couponBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	c, err := scanCoupon(db.QueryRow(r.Context(), `SELECT `+couponColumns+` FROM coupons WHERE code = $1`, body.Code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "coupon not found")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if msg := c.unusable(time.Now()); msg != "" {
+		writeError(w, http.StatusConflict, codeConflict, msg)
+		return
+	}
+	writeCouponResult(w, c, body.AmountCents)
+}
+
+// redeemCoupon serves POST /coupons/redeem. It uses the code up once in a
+// single conditional UPDATE, so concurrent redemptions can't exceed
+// max_uses, and returns the discount like validateCoupon.
+func redeemCoupon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+	var body couponBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	c, err := scanCoupon(db.QueryRow(ctx,
+		`UPDATE coupons SET used_count = used_count + 1
+		 WHERE code = $1 AND (expires_at IS NULL OR expires_at > now()) AND (max_uses IS NULL OR used_count < max_uses)
+		 RETURNING `+couponColumns, body.Code,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		// missing, expired or used up: read it back to say which
+		c, err = scanCoupon(db.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupons WHERE code = $1`, body.Code))
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			writeError(w, http.StatusNotFound, codeNotFound, "coupon not found")
+		case err != nil:
+			writeDBError(w, err, "db error")
+		default:
+			msg := c.unusable(time.Now())
+			if msg == "" {
+				msg = "coupon has expired" // by the database clock
+			}
+			writeError(w, http.StatusConflict, codeConflict, msg)
+		}
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	writeCouponResult(w, c, body.AmountCents)
+}
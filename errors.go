@@ -0,0 +1,62 @@
+package main
+
+import "net/http"
+
+// Error codes: the stable, machine-readable part of an error response.
+// Clients branch on these; messages may change.
+const (
+	codeBadRequest           = "BAD_REQUEST"
+	codeInvalidID            = "INVALID_ID"
+	codeValidation           = "VALIDATION_FAILED"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeForbidden            = "FORBIDDEN"
+	codeNotFound             = "NOT_FOUND"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeNotAcceptable        = "NOT_ACCEPTABLE"
+	codeConflict             = "CONFLICT"
+	codeInsufficientStock    = "INSUFFICIENT_STOCK"
+	codePreconditionFailed   = "PRECONDITION_FAILED"
+	codePreconditionRequired = "PRECONDITION_REQUIRED"
+	codePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	codeUnsupportedMedia     = "UNSUPPORTED_MEDIA_TYPE"
+	codeRateLimited          = "RATE_LIMITED"
+	codeInternal             = "INTERNAL"
+	codeDBError              = "DB_ERROR"
+	codeTimeout              = "TIMEOUT"
+	codeUnavailable          = "UNAVAILABLE"
+)
+
+// apiError is the body of every error response, under "error". Fields is
+// set on validation failures and ProductID when one product caused the
+// error. RequestID is the X-Request-ID set by withRequestID.
+type apiError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Fields    fieldErrors `json:"fields,omitempty"`
+	ProductID string      `json:"productId,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// writeError writes {"error": {"code": code, "message": msg, ...}}.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeAPIError(w, status, apiError{Code: code, Message: msg})
+}
+
+// writeAPIError is writeError for errors with more than a code and message.
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	e.RequestID = w.Header().Get("X-Request-ID")
+	writeJSON(w, status, map[string]apiError{"error": e})
+}
+
+// fieldErrors maps JSON field names to validation messages.
+type fieldErrors map[string]string
+
+// writeFieldErrors answers a request that failed validation with 400.
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	writeAPIError(w, http.StatusBadRequest, apiError{Code: codeValidation, Message: "validation failed", Fields: errs})
+}
+
+// notFound answers paths no route matches.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, codeNotFound, "not found")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// product change types, shared by the SSE stream and lifecycle webhooks
+const (
+	eventCreated = "product.created"
+	eventUpdated = "product.updated"
+	eventDeleted = "product.deleted"
+)
+
+// productChange says which products changed and how. It travels between
+// instances on invalidateChannel and is the data of each SSE event. Stock
+// maps ids to their new stock when the change is known to the writer.
+type productChange struct {
+	Type  string         `json:"type"`
+	IDs   []string       `json:"ids"`
+	Stock map[string]int `json:"stock,omitempty"`
+}
+
+// sseKeepAlive is how often an idle stream gets a comment line, well under
+// the usual 60s proxy idle timeout. SSE_KEEPALIVE overrides it.
+var sseKeepAlive = 15 * time.Second
+
+// changes fans product changes out to this instance's SSE and WebSocket
+// streams.
+var changes = &changeHub{subs: map[chan productChange]struct{}{}}
+
+// changeHub is a broadcast point with one buffered channel per subscriber.
+// A subscriber that falls a full buffer behind is dropped (its channel is
+// closed) rather than holding up the rest; its client reconnects and
+// refetches.
+type changeHub struct {
+	mu     sync.Mutex
+	subs   map[chan productChange]struct{}
+	closed bool
+}
+
+// subscribe returns a channel of changes and a func to unsubscribe. The
+// channel is closed when the hub drops the subscriber or shuts down.
+func (h *changeHub) subscribe() (<-chan productChange, func()) {
+	ch := make(chan productChange, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *changeHub) publish(c productChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- c:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every stream so graceful shutdown isn't held up by them.
+func (h *changeHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// streamProductEvents serves GET /products/events, a Server-Sent Events
+// stream with one event per product change on any instance, named after
+// the change type. Events carry ids only; clients fetch what they need.
+func streamProductEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+
+	// the stream outlives the server's read and write timeouts; an expired
+	// read deadline would also cancel ctx
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "streaming unsupported")
+		return
+	}
+	rc.SetReadDeadline(time.Time{})
+
+	ch, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // stop nginx buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	rc.Flush()
+
+	t := time.NewTicker(sseKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(c)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", c.Type, data); err != nil {
+				return
+			}
+		case <-t.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
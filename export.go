@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// exportProductsCSV serves GET /products.csv. It accepts the same filters and
+// sort as GET /products but ignores pagination, streaming every matching row
+// straight to the client.
+func exportProductsCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+	rows, ok := exportRows(w, r)
+	if !ok {
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "priceCents", "stock", "currency", "created_at"})
+
+	// headers are already sent once rows stream, so errors past this point
+	// can only be logged and the response truncated
+	n := 0
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			slog.ErrorContext(ctx, "csv export scan failed", "err", err)
+			return
+		}
+		cw.Write([]string{p.ID, p.Name, strconv.Itoa(p.PriceCents), strconv.Itoa(p.Stock), p.Currency, p.CreatedAt})
+		if n++; n%500 == 0 {
+			cw.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "csv export failed", "err", err)
+	}
+	cw.Flush()
+}
+
+// exportRows runs the unpaginated query shared by the exports: the filters
+// and sort of GET /products over every matching row. It answers the request
+// itself and returns ok=false if the params are bad or the query fails.
+func exportRows(w http.ResponseWriter, r *http.Request) (pgx.Rows, bool) {
+	lp, err := parseListParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return nil, false
+	}
+	var sw sqlWhere
+	lp.applyFilters(&sw)
+	order := lp.orderBy(&sw)
+	rows, err := db.Query(r.Context(),
+		`SELECT `+productColumns+` FROM products`+productJoins+sw.String()+` ORDER BY `+order,
+		sw.args...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeDBError, "db error")
+		return nil, false
+	}
+	return rows, true
+}
+
+// exportProductsNDJSON serves GET /products as application/x-ndjson: one
+// product object per line over every matching row, like /products.csv,
+// with limit, offset and cursor ignored. Rows are encoded as they are read
+// and flushed every 500, so memory stays flat however large the catalogue.
+func exportProductsNDJSON(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Add("Vary", "Accept")
+	rows, ok := exportRows(w, r)
+	if !ok {
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", contentNDJSON)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w) // Encode ends every value with a newline
+	n := 0
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			slog.ErrorContext(ctx, "ndjson export scan failed", "err", err)
+			return
+		}
+		if err := enc.Encode(p); err != nil {
+			return // client gone
+		}
+		if n++; n%500 == 0 {
+			rc.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "ndjson export failed", "err", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// idempotencyTTL is how long an Idempotency-Key is remembered.
+const idempotencyTTL = 24 * time.Hour
+
+const maxIdempotencyKeyLength = 255
+
+// errIdempotencyMismatch means the key was already used with another body.
+var errIdempotencyMismatch = errors.New("idempotency key reused with a different request")
+
+// claimIdempotencyKey reserves key for a request whose body hashes to hash,
+// within the tx that performs the create. It returns the stored response
+// if the key was already used for the same request, errIdempotencyMismatch
+// if it was used for a different one, and (nil, nil) if the caller now owns
+// the key and must finish it with storeIdempotentResponse before committing.
+//
+// A concurrent request with the same key blocks on the INSERT until the
+// owner's transaction ends, then either replays its response or, if the
+// owner rolled back, claims the key itself.
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, key string, hash []byte) ([]byte, error) {
+	// expired keys are swept here rather than by a background job
+	if _, err := tx.Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, time.Now().Add(-idempotencyTTL)); err != nil {
+		return nil, err
+	}
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO idempotency_keys(key, request_hash) VALUES($1, $2) ON CONFLICT (key) DO NOTHING`, key, hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, nil
+	}
+	var storedHash, response []byte
+	if err := tx.QueryRow(ctx,
+		`SELECT request_hash, response FROM idempotency_keys WHERE key = $1`, key,
+	).Scan(&storedHash, &response); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(storedHash, hash) {
+		return nil, errIdempotencyMismatch
+	}
+	return response, nil
+}
+
+// storeIdempotentResponse records the response body of the request that
+// claimed key.
+func storeIdempotentResponse(ctx context.Context, tx pgx.Tx, key string, response []byte) error {
+	_, err := tx.Exec(ctx, `UPDATE idempotency_keys SET response = $2 WHERE key = $1`, key, response)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxImportErrors caps how many failing lines are reported back.
+const maxImportErrors = 100
+
+// importMaxBytes caps CSV uploads (IMPORT_MAX_BYTES) in place of
+// maxBodyBytes.
+var importMaxBytes int64 = 10 << 20
+
+type importLineError struct {
+	Line   int         `json:"line"`
+	Errors fieldErrors `json:"errors"`
+}
+
+type importSummary struct {
+	Inserted int               `json:"inserted"`
+	Skipped  int               `json:"skipped"`
+	Errors   []importLineError `json:"errors"`
+}
+
+// importProducts serves POST /products/import. The text/csv body has the
+// columns name,priceCents,stock (an optional header row with those names is
+// skipped); imported products are priced in defaultCurrency. Rows are
+// streamed straight into a COPY, so the file is never held in memory;
+// invalid rows are skipped and reported by line number. The import runs in
+// one transaction, so a conflicting name aborts all of it.
+func importProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "text/csv" {
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "content type must be text/csv")
+		return
+	}
+	ctx := r.Context()
+
+	cr := csv.NewReader(r.Body) // capped at importMaxBytes by withBodyLimit
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	summary := importSummary{Errors: []importLineError{}}
+	skip := func(line int, errs fieldErrors) {
+		summary.Skipped++
+		if len(summary.Errors) < maxImportErrors {
+			summary.Errors = append(summary.Errors, importLineError{Line: line, Errors: errs})
+		}
+	}
+
+	// ids and the rendered prices of the rows copied so far, for the audit
+	var ids [][16]byte
+	var prices, formatted []string
+	first := true
+	next := func() ([]any, error) {
+		for {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return nil, nil
+			}
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				skip(perr.Line, fieldErrors{"row": perr.Err.Error()})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				first = false
+				if strings.EqualFold(rec[0], "name") && strings.EqualFold(rec[1], "priceCents") && strings.EqualFold(rec[2], "stock") {
+					continue
+				}
+			}
+
+			line, _ := cr.FieldPos(0)
+			body, errs := parseImportRecord(rec)
+			if len(errs) > 0 {
+				skip(line, errs)
+				continue
+			}
+			id := [16]byte(uuid.New())
+			ids = append(ids, id)
+			display := Product{PriceCents: body.PriceCents, Currency: body.Currency}
+			display.setDisplayPrice()
+			prices, formatted = append(prices, display.Price), append(formatted, display.PriceFormatted)
+			now := time.Now().UTC()
+			return []any{id, body.Name, body.PriceCents, body.Stock, body.Currency, now, now}, nil
+		}
+	}
+
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		n, err := tx.CopyFrom(ctx, pgx.Identifier{"products"},
+			[]string{"id", "name", "price_cents", "stock", "currency", "created_at", "updated_at"}, pgx.CopyFromFunc(next))
+		if err != nil {
+			return err
+		}
+		summary.Inserted = int(n)
+		// audit rows are built in SQL from the ids and the prices setDisplayPrice
+		// rendered, so the rows themselves needn't be kept around. The JSON
+		// has every field Product encodes, with timestamps to the second as
+		// scanProduct formats them, so import events look like create events
+		_, err = tx.Exec(ctx, `
+INSERT INTO product_audit(product_id, action, new_value)
+SELECT id, $2, jsonb_build_object(
+  'id', id, 'name', name, 'sku', sku, 'description', description, 'imageUrl', image_url, 'priceCents', price_cents, 'price', d.price, 'priceFormatted', d.price_formatted, 'salePriceCents', NULL, 'saleStartsAt', NULL, 'saleEndsAt', NULL, 'effectivePriceCents', price_cents, 'stock', stock, 'availableStock', stock, 'lowStockThreshold', low_stock_threshold, 'currency', currency, 'version', version,
+  'created_at', to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+  'updated_at', to_char(updated_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+  'categoryId', NULL, 'category', NULL, 'tags', '[]'::jsonb)
+FROM products JOIN unnest($1::uuid[], $3::text[], $4::text[]) AS d(id, price, price_formatted) USING (id)`, ids, auditCreate, prices, formatted)
+		return err
+	})
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "upload too large")
+		return
+	case isUniqueViolation(err):
+		writeError(w, http.StatusConflict, codeConflict, "import contains a name that already exists; nothing was imported")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, codeDBError, "import error")
+		return
+	}
+
+	if summary.Inserted > 0 {
+		created := make([]string, len(ids))
+		for i, id := range ids {
+			created[i] = uuid.UUID(id).String()
+		}
+		invalidateProducts(ctx, eventCreated, created...)
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// parseImportRecord converts a name,priceCents,stock record and validates it
+// with the same rules as POST /products.
+func parseImportRecord(rec []string) (createBody, fieldErrors) {
+	var body createBody
+	errs := fieldErrors{}
+	body.Name = rec[0] // validate normalizes it
+	var err error
+	if body.PriceCents, err = strconv.Atoi(strings.TrimSpace(rec[1])); err != nil {
+		errs["priceCents"] = "must be an integer"
+	}
+	if body.Stock, err = strconv.Atoi(strings.TrimSpace(rec[2])); err != nil {
+		errs["stock"] = "must be an integer"
+	}
+	for k, v := range body.validate() {
+		if _, ok := errs[k]; !ok {
+			errs[k] = v
+		}
+	}
+	return body, errs
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the JWT claims this service reads. They are stored in the
+// request context; use claimsFrom to get them.
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type claimsKey struct{}
+
+// claimsFrom returns the caller's verified claims, or nil when JWT auth is
+// disabled.
+func claimsFrom(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsKey{}).(*Claims)
+	return c
+}
+
+// jwtVerifier checks HS256 tokens against a shared secret or RS256 tokens
+// against the keys published at a JWKS URL, whichever is configured.
+type jwtVerifier struct {
+	secret []byte
+	jwks   *jwksCache
+}
+
+func (v *jwtVerifier) keyFunc(t *jwt.Token) (any, error) {
+	if v.secret != nil {
+		return v.secret, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	return v.jwks.key(kid)
+}
+
+func (v *jwtVerifier) parse(raw string) (*Claims, error) {
+	method := jwt.SigningMethodHS256.Alg()
+	if v.secret == nil {
+		method = jwt.SigningMethodRS256.Alg()
+	}
+	var c Claims
+	// tokens without exp never expire, so they are rejected outright
+	_, err := jwt.ParseWithClaims(raw, &c, v.keyFunc,
+		jwt.WithValidMethods([]string{method}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// withJWT requires a valid Bearer token on every request except health,
+// version and metrics probes and CORS preflights. Writes additionally need role "admin".
+func withJWT(v *jwtVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodOptions,
+			r.URL.Path == "/health", r.URL.Path == "/ready", r.URL.Path == "/version", r.URL.Path == "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || raw == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing bearer token")
+			return
+		}
+		claims, err := v.parse(raw)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "invalid token")
+			return
+		}
+		if !safeMethod(r.Method) && claims.Role != "admin" {
+			writeError(w, http.StatusForbidden, codeForbidden, "admin role required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// --- JWKS ---
+
+// jwksCache fetches RSA public keys from a JWKS endpoint and refetches (at
+// most once per minRefresh) when a token names an unknown kid, which is how
+// key rotation shows up.
+type jwksCache struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: 5 * time.Second}, minRefresh: time.Minute}
+}
+
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(c.fetched) < c.minRefresh {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	if k, ok := c.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// refresh must be called with mu held.
+func (c *jwksCache) refresh() error {
+	c.fetched = time.Now()
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks fetch: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err := errors.Join(err1, err2); err != nil {
+			return fmt.Errorf("jwks key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	c.keys = keys
+	return nil
+}
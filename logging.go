@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// logLevel is the minimum level logged (LOG_LEVEL: debug, info, warn or
+// error; default info). SIGHUP switches it between that and debug.
+var logLevel slog.LevelVar
+
+// setupLogging installs the default slog logger: JSON lines when
+// LOG_FORMAT=json (production), human-readable text otherwise. The stdlib
+// log package is routed through it as well.
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler
+	if os.Getenv("LOG_FORMAT") == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			fatal("LOG_LEVEL must be debug, info, warn or error", "value", v)
+		}
+	}
+}
+
+// toggleDebugOnHUP switches logLevel to debug on SIGHUP and back to the
+// configured level on the next one, so a live instance can be diagnosed
+// without a redeploy.
+func toggleDebugOnHUP() {
+	configured := logLevel.Level()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next := slog.LevelDebug
+			if logLevel.Level() == slog.LevelDebug {
+				next = configured
+			}
+			logLevel.Set(next)
+			slog.Warn("log level changed", "level", next)
+		}
+	}()
+}
+
+// contextHandler adds the request_id of the record's context, so callers
+// only need to use the *Context logging variants.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs msg at error level and exits, replacing log.Fatalf so startup
+// failures are structured records too.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,30 +1,90 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 )
 
 type Product struct {
-	ID         string `json:"id"`
-	Name       string `json:"name"`
-	PriceCents int    `json:"priceCents"`
-	Stock      int    `json:"stock"`
-	CreatedAt  string `json:"created_at"`
+	XMLName     xml.Name `json:"-" xml:"product"`
+	ID          string   `json:"id" xml:"id"`
+	Name        string   `json:"name" xml:"name"`
+	SKU         *string  `json:"sku" xml:"sku,omitempty"`
+	Description *string  `json:"description" xml:"description,omitempty"`
+	ImageURL    *string  `json:"imageUrl" xml:"imageUrl,omitempty"`
+	// PriceCents, like every *Cents amount, counts in Currency's minor
+	// unit: cents for USD, whole yen for JPY.
+	PriceCents int `json:"priceCents" xml:"priceCents"`
+	// Price and PriceFormatted render PriceCents as a decimal string
+	// ("12.99") and for display in Currency ("$12.99"). They are computed
+	// and ignored on input.
+	Price          string `json:"price" xml:"price"`
+	PriceFormatted string `json:"priceFormatted" xml:"priceFormatted"`
+	// SalePriceCents replaces PriceCents between SaleStartsAt and
+	// SaleEndsAt; either bound may be null for an open-ended sale.
+	// EffectivePriceCents is whichever applies now.
+	SalePriceCents      *int    `json:"salePriceCents" xml:"salePriceCents,omitempty"`
+	SaleStartsAt        *string `json:"saleStartsAt" xml:"saleStartsAt,omitempty"`
+	SaleEndsAt          *string `json:"saleEndsAt" xml:"saleEndsAt,omitempty"`
+	EffectivePriceCents int     `json:"effectivePriceCents" xml:"effectivePriceCents"`
+	Stock               int     `json:"stock" xml:"stock"`
+	// AvailableStock is Stock less the units held by active reservations.
+	AvailableStock int `json:"availableStock" xml:"availableStock"`
+	// LowStockThreshold is null when the product never raises low-stock
+	// alerts.
+	LowStockThreshold *int   `json:"lowStockThreshold" xml:"lowStockThreshold,omitempty"`
+	Currency          string `json:"currency" xml:"currency"`
+	Version           int    `json:"version" xml:"version"`
+	CreatedAt         string `json:"created_at" xml:"created_at"`
+	UpdatedAt         string `json:"updated_at" xml:"updated_at"`
+	// CategoryID and Category (the category's name) are null when the
+	// product is uncategorised.
+	CategoryID *string  `json:"categoryId" xml:"categoryId,omitempty"`
+	Category   *string  `json:"category" xml:"category,omitempty"`
+	Tags       []string `json:"tags" xml:"tags>tag"` // sorted, never null
+
+	createdAt time.Time // full precision, used for cursors
+	updatedAt time.Time // full precision, used for Last-Modified
 }
 
 var (
 	db  *pgxpool.Pool
 	rdb *redis.Client // nil if REDIS_URL not set
+
+	productsCacheTTL = 30 * time.Second // PRODUCTS_CACHE_TTL
+	// listCacheMaxBytes is the largest list page cached
+	// (LIST_CACHE_MAX_BYTES); bigger pages are rebuilt on every request
+	// rather than pushed through Redis.
+	listCacheMaxBytes = 1 << 20
 )
 
 // --- helpers ---
@@ -32,217 +92,2354 @@ var (
 func mustGetEnv(k string) string {
 	v := os.Getenv(k)
 	if v == "" {
-		log.Fatalf("missing env: %s", k)
+		fatal("missing env", "key", k)
 	}
 	return v
 }
 
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// envDuration parses a Go duration string from env k, returning def when unset.
+func envDuration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fatal("invalid env", "key", k, "err", err)
+	}
+	return d
+}
+
+// envInt parses an integer from env k, returning def when unset.
+func envInt(k string, def int) int {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("invalid env", "key", k, "err", err)
+	}
+	return n
+}
+
+// envFloat parses a float from env k, returning def when unset.
+func envFloat(k string, def float64) float64 {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		fatal("invalid env", "key", k, "err", err)
+	}
+	return f
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// queryTimeout bounds the DB work of a request (DB_QUERY_TIMEOUT).
+var queryTimeout = 5 * time.Second
+
+// withQueryTimeout derives a request context that expires after
+// queryTimeout, so every DB call a handler makes with it is bounded. Only
+// wrap routes whose whole database work is short; streaming endpoints are
+// left out.
+func withQueryTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// isTimeout reports whether a DB error was caused by a deadline.
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
+
+// writeDBError answers a failed DB call: 504 when it timed out, otherwise a
+// 500 with msg.
+func writeDBError(w http.ResponseWriter, err error, msg string) {
+	if isTimeout(err) {
+		writeError(w, http.StatusGatewayTimeout, codeTimeout, "database timeout")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeDBError, msg)
+}
+
+// maxBodyBytes caps request bodies (MAX_BODY_BYTES); withBodyLimit applies
+// it to every route but CSV import.
+var maxBodyBytes int64 = 1 << 20
+
+// decodeBody strictly decodes a JSON body, size-capped by withBodyLimit,
+// into dst. On failure it writes the error response and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err == nil {
+		return true
+	}
+
+	var tooBig *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooBig):
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "request body too large")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for this; the message is stable
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeFieldErrors(w, fieldErrors{field: "unknown field"})
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeFieldErrors(w, fieldErrors{typeErr.Field: "must be of type " + typeErr.Type.String()})
+	default:
+		writeError(w, http.StatusBadRequest, codeBadRequest, "bad json: "+err.Error())
+	}
+	return false
 }
 
 // --- main ---
 
 func main() {
+	startTime = time.Now()
 	ctx := context.Background()
+	setupLogging()
+	toggleDebugOnHUP()
+	slog.Info("starting store-svc", "version", version, "commit", buildCommit())
+
+	// Tracing (optional)
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		fatal("tracing setup error", "err", err)
+	}
+	if tracingEnabled {
+		slog.Info("tracing enabled", "exporter", "otlp")
+	}
 
 	// Postgres
-	pool, err := pgxpool.New(ctx, mustGetEnv("DATABASE_URL"))
+	cfg, err := pgxpool.ParseConfig(mustGetEnv("DATABASE_URL"))
+	if err != nil {
+		fatal("db config error", "err", err)
+	}
+	if tracingEnabled {
+		cfg.ConnConfig.Tracer = pgxTracer{}
+	}
+	slowQueryThreshold = envDuration("SLOW_QUERY_THRESHOLD", slowQueryThreshold)
+	if slowQueryThreshold < 0 {
+		fatal("SLOW_QUERY_THRESHOLD must be >= 0", "threshold", slowQueryThreshold)
+	}
+	if slowQueryThreshold > 0 {
+		t := slowQueryTracer{}
+		if tracingEnabled {
+			t.next = &pgxTracer{}
+		}
+		cfg.ConnConfig.Tracer = t
+	}
+	configurePool(cfg)
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 	if err != nil {
-		log.Fatalf("db connect error: %v", err)
+		fatal("db connect error", "err", err)
 	}
 	db = pool
-	defer db.Close()
+	// the pool connects lazily; fail (or wait for Postgres) here, not mid-migration
+	err = retryBackoff(ctx, "postgres", envInt("DB_CONNECT_ATTEMPTS", 1), envDuration("DB_CONNECT_DELAY", 500*time.Millisecond), db.Ping)
+	if err != nil {
+		fatal("db ping error", "err", err)
+	}
 
-	// Ensure schema
-	if err := initSchema(ctx); err != nil {
-		log.Fatalf("init schema: %v", err)
+	// Schema
+	if err := migrate(ctx); err != nil {
+		fatal("migrate error", "err", err)
+	}
+	if err := ensureUniqueName(ctx); err != nil {
+		fatal("unique name index error", "err", err)
 	}
 
 	// Redis (optional)
 	if ru := os.Getenv("REDIS_URL"); ru != "" {
 		opt, err := redis.ParseURL(ru) // handles redis:// and rediss://
 		if err != nil {
-			log.Fatalf("redis parse error: %v", err)
+			fatal("redis parse error", "err", err)
 		}
 		rdb = redis.NewClient(opt)
-		if err := rdb.Ping(ctx).Err(); err != nil {
-			log.Fatalf("redis ping error: %v", err)
+		if tracingEnabled {
+			rdb.AddHook(redisTracingHook{})
 		}
-		log.Println("redis connected")
-	} else {
-		log.Println("redis disabled (REDIS_URL not set)")
+		err = retryBackoff(ctx, "redis", envInt("REDIS_CONNECT_ATTEMPTS", 5), envDuration("REDIS_CONNECT_DELAY", 500*time.Millisecond),
+			func(ctx context.Context) error { return rdb.Ping(ctx).Err() })
+		if err != nil {
+			// Redis is optional: run uncached rather than crash-loop
+			slog.Warn("redis unreachable, continuing with the cache disabled", "err", err)
+			rdb.Close()
+			rdb = nil
+		}
+	}
+	// read whether or not Redis is up: the local cache tier uses them too
+	productsCacheTTL = envDuration("PRODUCTS_CACHE_TTL", productsCacheTTL)
+	if productsCacheTTL <= 0 {
+		fatal("PRODUCTS_CACHE_TTL must be positive", "ttl", productsCacheTTL)
 	}
+	listCacheMaxBytes = envInt("LIST_CACHE_MAX_BYTES", listCacheMaxBytes)
+	if listCacheMaxBytes < 1 {
+		fatal("LIST_CACHE_MAX_BYTES must be positive", "max", listCacheMaxBytes)
+	}
+	slog.Info("products cache configured", "ttl", productsCacheTTL, "max_page_bytes", listCacheMaxBytes)
+	if rdb != nil {
+		slog.Info("redis connected")
+		redisBreaker = newBreaker(envInt("REDIS_BREAKER_THRESHOLD", 5), envDuration("REDIS_BREAKER_COOLDOWN", 30*time.Second))
+		subscribeInvalidations(ctx)
+	} else if os.Getenv("REDIS_URL") == "" {
+		slog.Info("redis disabled (REDIS_URL not set)")
+	}
+
+	// Low-stock alerts (optional)
+	if u := os.Getenv("LOW_STOCK_WEBHOOK_URL"); u != "" {
+		if !validHTTPURL(u) {
+			fatal("LOW_STOCK_WEBHOOK_URL must be an absolute http or https URL")
+		}
+		timeout := envDuration("LOW_STOCK_WEBHOOK_TIMEOUT", 5*time.Second)
+		if timeout <= 0 {
+			fatal("LOW_STOCK_WEBHOOK_TIMEOUT must be positive", "timeout", timeout)
+		}
+		secret := os.Getenv("LOW_STOCK_WEBHOOK_SECRET")
+		lowStockHook = newLowStockNotifier(u, []byte(secret), timeout, envInt("LOW_STOCK_WEBHOOK_ATTEMPTS", 5))
+		slog.Info("low stock webhook enabled", "timeout", timeout, "signed", secret != "")
+	}
+
+	// In-process cache in front of Redis; LOCAL_CACHE_SIZE=0 disables it
+	if size := envInt("LOCAL_CACHE_SIZE", 256); size > 0 {
+		ttl := envDuration("LOCAL_CACHE_TTL", 5*time.Second)
+		if ttl <= 0 {
+			fatal("LOCAL_CACHE_TTL must be positive", "ttl", ttl)
+		}
+		localCache = newLRUCache(size, ttl)
+		registerLocalCache(localCache.clear)
+		slog.Info("local cache enabled", "size", size, "ttl", ttl)
+	}
+
+	// WebSocket stock updates; origins follow the CORS allowlist
+	wsMaxConns := envInt("WS_MAX_CONNECTIONS", 1000)
+	wsPing := envDuration("WS_PING_INTERVAL", 30*time.Second)
+	if wsMaxConns < 1 || wsPing <= 0 {
+		fatal("WS_MAX_CONNECTIONS must be >= 1 and WS_PING_INTERVAL positive", "max", wsMaxConns, "ping", wsPing)
+	}
+	ws := newWSHandler(parseOrigins(os.Getenv("ALLOWED_ORIGINS")), wsMaxConns, wsPing)
 
 	// Routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", handleHealth)
-	mux.HandleFunc("/products", productsHandler)     // GET, POST
-	mux.HandleFunc("/products/", productItemHandler) // DELETE /products/:id
+	keys := parseAPIKeys(os.Getenv("API_KEYS"))
+	mux := newRoutes(ws, keys)
+	if err := checkSpecRoutes(mux); err != nil {
+		fatal("openapi.json is out of date with the routes", "err", err)
+	}
+	routes, err := specRouteMethods()
+	if err != nil {
+		fatal("openapi.json is invalid", "err", err)
+	}
+	// unmatched paths get a JSON 404 too; like pprof below, the catch-all
+	// bypasses checkSpecRoutes
+	mux.ServeMux.HandleFunc("/", notFound)
+
+	// Profiling (optional). pprof isn't part of the API, so it goes on the
+	// ServeMux directly, out of checkSpecRoutes' sight, and always needs an
+	// API key
+	if os.Getenv("PPROF_ENABLED") == "true" {
+		if len(keys) == 0 {
+			fatal("PPROF_ENABLED requires API_KEYS, so profiles aren't public")
+		}
+		mux.ServeMux.Handle("/debug/pprof/", requireAPIKey(keys, pprofHandler()))
+		slog.Warn("pprof enabled", "path", "/debug/pprof/")
+	}
+
+	// pool stats carry no more than /metrics does, so unlike pprof they need
+	// no key; being debug output, they stay out of the spec too
+	mux.ServeMux.HandleFunc("/debug/pool", handlePoolStats)
+
+	registerPoolMetrics()
+	var handler http.Handler = withGzip(mux)
+
+	// API keys for writes (optional)
+	if len(keys) > 0 {
+		handler = withAPIKey(keys, handler)
+		slog.Info("api key auth enabled for writes", "keys", len(keys))
+	} else {
+		slog.Info("api key auth disabled (API_KEYS not set)")
+	}
+
+	// JWT auth (optional): HS256 shared secret or RS256 via JWKS
+	switch secret, jwksURL := os.Getenv("JWT_SECRET"), os.Getenv("JWKS_URL"); {
+	case secret != "" && jwksURL != "":
+		fatal("set only one of JWT_SECRET and JWKS_URL")
+	case secret != "":
+		handler = withJWT(&jwtVerifier{secret: []byte(secret)}, handler)
+		slog.Info("jwt auth enabled", "alg", "HS256")
+	case jwksURL != "":
+		handler = withJWT(&jwtVerifier{jwks: newJWKSCache(jwksURL)}, handler)
+		slog.Info("jwt auth enabled", "alg", "RS256", "jwks_url", jwksURL)
+	}
+	cors := corsConfig{
+		origins:     parseOrigins(os.Getenv("ALLOWED_ORIGINS")),
+		maxAge:      envDuration("CORS_MAX_AGE", 0),
+		methods:     corsList(os.Getenv("CORS_ALLOWED_METHODS"), defaultCORSMethods),
+		headers:     corsList(os.Getenv("CORS_ALLOWED_HEADERS"), defaultCORSHeaders),
+		credentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+		routes:      routes,
+	}
+	switch {
+	case cors.maxAge < 0:
+		fatal("CORS_MAX_AGE must not be negative", "max_age", cors.maxAge)
+	case cors.credentials && cors.origins == nil:
+		fatal("CORS_ALLOW_CREDENTIALS requires ALLOWED_ORIGINS")
+	}
+	handler = withCORS(cors, handler)
+	if cors.origins == nil {
+		slog.Info("cors allows any origin (ALLOWED_ORIGINS not set)")
+	} else {
+		slog.Info("cors origin allowlist enabled", "origins", len(cors.origins), "credentials", cors.credentials)
+	}
+
+	// clients are told apart by socket peer, or behind trusted proxies by
+	// X-Forwarded-For
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		fatal("TRUSTED_PROXIES must be comma-separated IPs or CIDRs", "err", err)
+	}
 
-	handler := withCORS(mux)
+	// Rate limiting (optional): shared through Redis, or per instance
+	if os.Getenv("RATE_LIMIT_STORE") == "redis" {
+		if os.Getenv("REDIS_URL") == "" {
+			fatal("RATE_LIMIT_STORE=redis requires REDIS_URL")
+		}
+		l := &redisLimiter{limit: envInt("RATE_LIMIT_LIMIT", 60), window: envDuration("RATE_LIMIT_WINDOW", time.Minute)}
+		if l.limit < 1 || l.window < time.Millisecond {
+			fatal("RATE_LIMIT_LIMIT must be >= 1 and RATE_LIMIT_WINDOW >= 1ms", "limit", l.limit, "window", l.window)
+		}
+		handler = withRateLimit(l, handler)
+		slog.Info("redis rate limit enabled", "limit", l.limit, "window", l.window)
+		if rdb == nil {
+			slog.Warn("redis unreachable, rate limiting fails open until restart")
+		}
+	} else if rps := envFloat("RATE_LIMIT_RPS", 0); rps > 0 {
+		burst := envInt("RATE_LIMIT_BURST", int(math.Ceil(rps)))
+		handler = withRateLimit(newIPLimiter(rps, burst, 5*time.Minute), handler)
+		slog.Info("rate limit enabled", "rps", rps, "burst", burst)
+	}
+	handler = withTracing(mux.ServeMux, withRequestID(withLogging(withMetrics(mux.ServeMux, withRecover(withRequestTimeout(withBodyLimit(handler)))))))
 
 	// Serve
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// LISTEN_ADDR wins over the older PORT, which binds every interface
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":" + cmp.Or(os.Getenv("PORT"), "8080")
+	}
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		fatal("invalid LISTEN_ADDR", "addr", addr, "err", err)
+	}
+	queryTimeout = envDuration("DB_QUERY_TIMEOUT", queryTimeout)
+	if queryTimeout <= 0 {
+		fatal("DB_QUERY_TIMEOUT must be positive", "timeout", queryTimeout)
+	}
+	importMaxBytes = int64(envInt("IMPORT_MAX_BYTES", int(importMaxBytes)))
+	maxBodyBytes = int64(envInt("MAX_BODY_BYTES", int(maxBodyBytes)))
+	if maxBodyBytes < 1 || importMaxBytes < 1 {
+		fatal("MAX_BODY_BYTES and IMPORT_MAX_BYTES must be positive", "max_body_bytes", maxBodyBytes, "import_max_bytes", importMaxBytes)
+	}
+	defaultCurrency = cmp.Or(os.Getenv("DEFAULT_CURRENCY"), defaultCurrency)
+	if _, ok := currencies[defaultCurrency]; !ok {
+		fatal("DEFAULT_CURRENCY must be a supported currency", "currency", defaultCurrency)
+	}
+	maxPriceCents = envInt("MAX_PRICE_CENTS", maxPriceCents)
+	if maxPriceCents < 1 {
+		fatal("MAX_PRICE_CENTS must be at least 1", "max", maxPriceCents)
+	}
+	maxNameLength = envInt("PRODUCT_NAME_MAX_LENGTH", maxNameLength)
+	if maxNameLength < 1 {
+		fatal("PRODUCT_NAME_MAX_LENGTH must be at least 1", "length", maxNameLength)
+	}
+	cartTTL = envDuration("CART_TTL", cartTTL)
+	if cartTTL <= 0 {
+		fatal("CART_TTL must be positive", "ttl", cartTTL)
+	}
+	reservationTTL = envDuration("RESERVATION_TTL", reservationTTL)
+	if reservationTTL <= 0 || reservationTTL > maxReservationTTL {
+		fatal("RESERVATION_TTL must be positive and at most 24h", "ttl", reservationTTL)
+	}
+	sweepEvery := envDuration("RESERVATION_SWEEP_INTERVAL", time.Minute)
+	if sweepEvery <= 0 {
+		fatal("RESERVATION_SWEEP_INTERVAL must be positive", "interval", sweepEvery)
+	}
+	skuRequired = os.Getenv("SKU_REQUIRED") == "true"
+	sseKeepAlive = envDuration("SSE_KEEPALIVE", sseKeepAlive)
+	if sseKeepAlive <= 0 {
+		fatal("SSE_KEEPALIVE must be positive", "interval", sseKeepAlive)
+	}
+
+	drainTimeout := envDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		fatal("tls config error", "err", err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	configureServerTimeouts(srv)
+	srv.RegisterOnShutdown(changes.close) // event streams never finish on their own
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Lifecycle webhooks: deliveries are queued by the database, so every
+	// instance runs a worker and they share the queue
+	worker := &webhookWorker{
+		client:      &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+		interval:    envDuration("WEBHOOK_POLL_INTERVAL", time.Second),
+		baseDelay:   envDuration("WEBHOOK_RETRY_DELAY", 5*time.Second),
+		maxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 10),
+	}
+	if worker.client.Timeout <= 0 || worker.interval <= 0 || worker.baseDelay <= 0 || worker.maxAttempts < 1 {
+		fatal("WEBHOOK_TIMEOUT, WEBHOOK_POLL_INTERVAL and WEBHOOK_RETRY_DELAY must be positive and WEBHOOK_MAX_ATTEMPTS >= 1")
+	}
+	go worker.run(sigCtx)
+	go sweepReservations(sigCtx, sweepEvery)
+
+	ln, err := listen(network, address)
+	if err != nil {
+		fatal("listen error", "network", network, "addr", address, "err", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		if tlsConfig == nil {
+			slog.Info("store-svc listening", "network", network, "addr", ln.Addr().String())
+			errc <- srv.Serve(ln)
+			return
+		}
+		slog.Info("store-svc listening", "network", network, "addr", ln.Addr().String(),
+			"tls", true, "mtls", tlsConfig.ClientCAs != nil)
+		// the certificate is already in tlsConfig
+		errc <- srv.ServeTLS(ln, "", "")
+	}()
+
+	select {
+	case err := <-errc:
+		fatal("http server error", "err", err)
+	case <-sigCtx.Done():
+	}
+	stop()
+
+	// drain in-flight requests, then close dependencies in order
+	slog.Info("shutting down", "drain_timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http shutdown error", "err", err)
 	}
-	log.Printf("store-svc listening on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	db.Close()
+	if rdb != nil {
+		if err := rdb.Close(); err != nil {
+			slog.Error("redis close error", "err", err)
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("tracing shutdown error", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+// parseListenAddr splits LISTEN_ADDR into a network and address for
+// net.Listen: "unix:/path/to.sock" is a Unix socket, anything else must be
+// host:port with a numeric port (an empty host, as in ":8080", binds every
+// interface).
+func parseListenAddr(s string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("unix: needs a socket path")
+		}
+		return "unix", path, nil
+	}
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("port %q must be a number from 0 to 65535", port)
+	}
+	return "tcp", s, nil
+}
+
+// listen is net.Listen, except that for a Unix socket it first removes a
+// socket file left behind by an unclean exit. The listener unlinks the file
+// again when it is closed.
+func listen(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// maxRetryDelay caps the backoff of retryBackoff.
+const maxRetryDelay = 10 * time.Second
+
+// retryBackoff calls fn up to attempts times, sleeping delay after the first
+// failure and doubling it (up to maxRetryDelay) after each further one, so
+// the service survives dependencies that start after it. It returns fn's
+// last error.
+func retryBackoff(ctx context.Context, name string, attempts int, delay time.Duration, fn func(context.Context) error) error {
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(ctx); err == nil || i >= attempts {
+			return err
+		}
+		slog.Warn("dependency not ready, retrying", "dependency", name, "attempt", i, "of", attempts, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// configureServerTimeouts sets the HTTP_* timeouts on srv, and the
+// handler deadline of withRequestTimeout, and logs them. Defaults: 5s to
+// read request headers (the slowloris guard), 30s to read the whole request,
+// 30s for a handler to answer, 60s to write the response (CSV import/export
+// included) and 120s for idle keep-alive connections. 0 disables a timeout,
+// except the header one, which must stay positive.
+func configureServerTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second)
+	srv.ReadTimeout = envDuration("HTTP_READ_TIMEOUT", 30*time.Second)
+	srv.WriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second)
+	srv.IdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second)
+	requestTimeout = envDuration("HTTP_REQUEST_TIMEOUT", requestTimeout)
+
+	switch {
+	case srv.ReadHeaderTimeout <= 0:
+		fatal("HTTP_READ_HEADER_TIMEOUT must be positive", "timeout", srv.ReadHeaderTimeout)
+	case srv.ReadTimeout < 0, srv.WriteTimeout < 0, srv.IdleTimeout < 0, requestTimeout < 0:
+		fatal("HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT, HTTP_IDLE_TIMEOUT and HTTP_REQUEST_TIMEOUT must not be negative")
+	case srv.ReadTimeout > 0 && srv.ReadTimeout < srv.ReadHeaderTimeout:
+		fatal("HTTP_READ_TIMEOUT must not be shorter than HTTP_READ_HEADER_TIMEOUT",
+			"read_timeout", srv.ReadTimeout, "read_header_timeout", srv.ReadHeaderTimeout)
+	}
+	slog.Info("http server timeouts configured",
+		"read_header", srv.ReadHeaderTimeout,
+		"read", srv.ReadTimeout,
+		"write", srv.WriteTimeout,
+		"idle", srv.IdleTimeout,
+		"request", requestTimeout,
+	)
+}
+
+// configurePool applies the DB_* pool env vars on top of the DSN/pgx
+// defaults, validates the result and logs the effective settings.
+func configurePool(cfg *pgxpool.Config) {
+	cfg.MaxConns = int32(envInt("DB_MAX_CONNS", int(cfg.MaxConns)))
+	cfg.MinConns = int32(envInt("DB_MIN_CONNS", int(cfg.MinConns)))
+	cfg.MaxConnLifetime = envDuration("DB_MAX_CONN_LIFETIME", cfg.MaxConnLifetime)
+	cfg.HealthCheckPeriod = envDuration("DB_HEALTH_CHECK_PERIOD", cfg.HealthCheckPeriod)
+
+	switch {
+	case cfg.MaxConns < 1:
+		fatal("DB_MAX_CONNS must be >= 1", "max_conns", cfg.MaxConns)
+	case cfg.MinConns < 0 || cfg.MinConns > cfg.MaxConns:
+		fatal("DB_MIN_CONNS must be between 0 and DB_MAX_CONNS", "min_conns", cfg.MinConns, "max_conns", cfg.MaxConns)
+	case cfg.MaxConnLifetime <= 0:
+		fatal("DB_MAX_CONN_LIFETIME must be positive", "max_conn_lifetime", cfg.MaxConnLifetime)
+	case cfg.HealthCheckPeriod <= 0:
+		fatal("DB_HEALTH_CHECK_PERIOD must be positive", "health_check_period", cfg.HealthCheckPeriod)
+	}
+	slog.Info("db pool configured",
+		"max_conns", cfg.MaxConns,
+		"min_conns", cfg.MinConns,
+		"max_conn_lifetime", cfg.MaxConnLifetime,
+		"health_check_period", cfg.HealthCheckPeriod,
+	)
 }
 
 // --- schema ---
 
-func initSchema(ctx context.Context) error {
-	_, err := db.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS products(
-  id uuid PRIMARY KEY,
-  name text NOT NULL,
-  price_cents int NOT NULL,
-  stock int NOT NULL,
-  created_at timestamptz NOT NULL DEFAULT now()
-);
+// The schema lives in migrations/ and is applied by migrate (migrate.go).
+
+// ensureUniqueName creates the case-insensitive unique index on the names of
+// live (not soft-deleted) products. Building it fails if the table already
+// holds duplicates, so in that case we log the offending names and start
+// without the index; it is created on the next boot once the duplicates have
+// been cleaned up. That data-dependent check is why it runs at startup after
+// migrate rather than as a migration.
+func ensureUniqueName(ctx context.Context) error {
+	rows, err := db.Query(ctx, `SELECT lower(name) FROM products WHERE deleted_at IS NULL GROUP BY 1 HAVING count(*) > 1 LIMIT 10`)
+	if err != nil {
+		return err
+	}
+	dups, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		slog.Warn("skipping unique index on products.name: duplicate names exist", "names", dups)
+		return nil
+	}
+	// products_name_lower_key predates soft delete and covered deleted rows too
+	_, err = db.Exec(ctx, `
+DROP INDEX IF EXISTS products_name_lower_key;
+CREATE UNIQUE INDEX IF NOT EXISTS products_name_lower_live_key ON products (lower(name)) WHERE deleted_at IS NULL;
 `)
 	return err
 }
 
+// isUniqueViolation reports whether err is a Postgres unique_violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// productConflict is the 409 message for a unique violation on products,
+// naming the column that clashed.
+func productConflict(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.ConstraintName == "products_sku_live_key" {
+		return "a product with this SKU already exists"
+	}
+	return "a product with this name already exists"
+}
+
+// isForeignKeyViolation reports whether err is a Postgres
+// foreign_key_violation, i.e. a product referencing a missing category.
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+// newRoutes registers the API routes documented in openapi.json. Routes
+// kept out of the spec, such as pprof, go on the returned mux's ServeMux.
+// With keys set, the webhook routes need one even to read: subscriptions
+// list their URLs and dead letters their payloads.
+func newRoutes(ws *wsHandler, keys apiKeys) *routeMux {
+	mux := newRouteMux()
+	private := func(h http.HandlerFunc) http.Handler {
+		if len(keys) == 0 {
+			return h
+		}
+		return requireAPIKey(keys, h)
+	}
+	mux.HandleFunc("/health", handleHealth)   // liveness
+	mux.HandleFunc("/ready", handleReady)     // readiness
+	mux.HandleFunc("/version", handleVersion) // build and uptime
+	mux.Handle("/metrics", getOnly(promhttp.Handler()))
+	mux.HandleFunc("/openapi.json", serveOpenAPI)
+	mux.HandleFunc("/docs", serveDocs)                                         // Swagger UI
+	mux.HandleFunc("/products", productsHandler)                               // GET (JSON, XML or streamed NDJSON), POST, DELETE (by filter)
+	mux.HandleFunc("/products/bulk", withQueryTimeout(bulkCreateProducts))     // POST
+	mux.HandleFunc("/products/batch", withQueryTimeout(getProductsBatch))      // GET ?ids=
+	mux.HandleFunc("/products/import", importProducts)                         // POST text/csv
+	mux.HandleFunc("/products.csv", exportProductsCSV)                         // GET
+	mux.HandleFunc("/products/count", withQueryTimeout(getProductsCount))      // GET
+	mux.HandleFunc("/products/random", withQueryTimeout(getRandomProducts))    // GET ?count=
+	mux.HandleFunc("/stats", withQueryTimeout(getStats))                       // GET
+	mux.HandleFunc("/products/events", streamProductEvents)                    // GET text/event-stream
+	mux.Handle("/ws", ws)                                                      // GET, upgrades to a WebSocket of stock changes
+	mux.HandleFunc("/products/by-sku/", withQueryTimeout(getProductBySKU))     // GET /products/by-sku/:sku
+	mux.HandleFunc("/categories", withQueryTimeout(categoriesHandler))         // GET, POST
+	mux.HandleFunc("/carts", withQueryTimeout(cartsHandler))                   // POST
+	mux.HandleFunc("/carts/", withQueryTimeout(cartItemHandler))               // GET /carts/:id, POST /carts/:id/items
+	mux.HandleFunc("/orders", withQueryTimeout(ordersHandler))                 // POST
+	mux.HandleFunc("/reservations/", withQueryTimeout(reservationItemHandler)) // POST /reservations/:id/confirm, POST /reservations/:id/cancel
+	mux.HandleFunc("/coupons", withQueryTimeout(couponsHandler))               // POST
+	mux.HandleFunc("/coupons/validate", withQueryTimeout(validateCoupon))      // POST
+	mux.HandleFunc("/coupons/redeem", withQueryTimeout(redeemCoupon))          // POST
+	mux.Handle("/webhooks", private(withQueryTimeout(webhooksHandler)))        // GET, POST
+	mux.Handle("/webhooks/", private(withQueryTimeout(webhookItemHandler)))    // DELETE /webhooks/:id, GET /webhooks/dead-letters
+	mux.HandleFunc("/products/", withQueryTimeout(productItemHandler))         // GET, PUT, PATCH, DELETE /products/:id, POST /products/:id/restore, GET /products/:id/history, GET /products/:id/price-history, POST /products/:id/reserve, POST /products/:id/purchase, PATCH /products/:id/stock
+	return mux
+}
+
+// getOnly answers 405 to anything but GET, for handlers such as promhttp's
+// that serve every method while the spec documents only GET.
+func getOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // --- handlers ---
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
+// handleReady pings every dependency and returns 503 if any is unreachable,
+// so load balancers take the instance out of rotation. Unlike /health it is
+// not meant for liveness probes.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	checks := map[string]string{}
+	ready := true
+	if err := db.Ping(ctx); err != nil {
+		checks["postgres"] = err.Error()
+		ready = false
+	} else {
+		checks["postgres"] = "ok"
+	}
+	if rdb != nil {
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			checks["redis"] = err.Error()
+			ready = false
+		} else {
+			checks["redis"] = "ok"
+		}
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// productsHandler routes /products. NDJSON streams every matching row, so
+// it alone runs without withQueryTimeout. HEAD runs GET in full; net/http
+// drops the body.
 func productsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case http.MethodGet:
-		getProducts(w, r)
+	case http.MethodGet, http.MethodHead:
+		if wantsNDJSON(r) {
+			exportProductsNDJSON(w, r)
+		} else {
+			withQueryTimeout(getProducts)(w, r)
+		}
 	case http.MethodPost:
-		createProduct(w, r)
+		withQueryTimeout(createProduct)(w, r)
+	case http.MethodDelete:
+		withQueryTimeout(deleteProducts)(w, r)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
 	}
 }
 
 func productItemHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	id := strings.TrimPrefix(r.URL.Path, "/products/")
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/products/"), "/")
 	if id == "" {
-		http.Error(w, "missing id", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidID, "missing id")
 		return
 	}
 	// validate UUID
 	if _, err := uuid.Parse(id); err != nil {
-		http.Error(w, "invalid id (must be UUID)", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidID, "invalid id (must be UUID)")
 		return
 	}
-	// delete (idempotent)
-	if _, err := db.Exec(r.Context(), `DELETE FROM products WHERE id = $1::uuid`, id); err != nil {
-		http.Error(w, "db error", http.StatusInternalServerError)
-		return
-	}
-	// invalidate cache
-	if rdb != nil {
-		_ = rdb.Del(r.Context(), "products:all").Err()
-	}
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func getProducts(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 
-	// 1) try cache
-	if rdb != nil {
-		if s, err := rdb.Get(ctx, "products:all").Result(); err == nil && s != "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(s))
+	switch sub {
+	case "":
+	case "restore":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
 			return
 		}
-	}
-
-	// 2) query DB
-	rows, err := db.Query(ctx, `SELECT id, name, price_cents, stock, created_at FROM products ORDER BY created_at DESC`)
-	if err != nil {
-		http.Error(w, "db error", http.StatusInternalServerError)
+		restoreProduct(w, r, id)
 		return
-	}
-	defer rows.Close()
-
-	list := make([]Product, 0)
-	for rows.Next() {
-		var p Product
-		var t time.Time
-		if err := rows.Scan(&p.ID, &p.Name, &p.PriceCents, &p.Stock, &t); err != nil {
-			http.Error(w, "scan error", http.StatusInternalServerError)
+	case "reserve":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		reserveProduct(w, r, id)
+		return
+	case "purchase":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		purchaseProduct(w, r, id)
+		return
+	case "stock":
+		if r.Method != http.MethodPatch {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		adjustStock(w, r, id)
+		return
+	case "history":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+			return
+		}
+		getProductHistory(w, r, id)
+		return
+	case "price-history":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
 			return
 		}
-		p.CreatedAt = t.Format(time.RFC3339)
-		list = append(list, p)
+		getPriceHistory(w, r, id)
+		return
+	default:
+		notFound(w, r)
+		return
 	}
 
-	// 3) write response + populate cache
-	w.Header().Set("Content-Type", "application/json")
-	b, _ := json.Marshal(list)
-	w.Write(b)
-	if rdb != nil {
-		_ = rdb.Set(ctx, "products:all", b, 30*time.Second).Err()
+	switch r.Method {
+	case http.MethodGet:
+		getProduct(w, r, id)
+	case http.MethodPut:
+		updateProduct(w, r, id)
+	case http.MethodPatch:
+		patchProduct(w, r, id)
+	case http.MethodDelete:
+		deleteProduct(w, r, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
 	}
 }
 
-type createBody struct {
-	Name       string `json:"name"`
-	PriceCents int    `json:"priceCents"`
-	Stock      int    `json:"stock"`
-}
+// productColumns is the select list scanProduct expects. It needs
+// productJoins after the products table (or a CTE named products).
+const productColumns = "id, name, sku, description, image_url, price_cents, sale_price_cents, sale_starts_at, sale_ends_at, stock, " + availableStockExpr + ", low_stock_threshold, currency, version, created_at, updated_at, category_id, category_name, COALESCE(tag_names, '{}')"
 
-func createProduct(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// productJoins adds category_name and tag_names. The category subquery
+// renames its columns so the unqualified product columns stay unambiguous.
+const productJoins = categoryJoin +
+	` LEFT JOIN LATERAL (SELECT array_agg(t.name ORDER BY t.name) AS tag_names FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.product_id = products.id) tg ON true`
 
-	var body createBody
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
+// categoryJoin is the part of productJoins the list filters need; counts
+// use it alone to skip aggregating tags.
+const categoryJoin = ` LEFT JOIN (SELECT id AS category_ref, name AS category_name FROM categories) c ON c.category_ref = category_id`
+
+// scanProduct reads productColumns into a Product.
+func scanProduct(row pgx.Row) (Product, error) {
+	var p Product
+	var t, u time.Time
+	var saleStarts, saleEnds *time.Time
+	if err := row.Scan(&p.ID, &p.Name, &p.SKU, &p.Description, &p.ImageURL, &p.PriceCents, &p.SalePriceCents, &saleStarts, &saleEnds, &p.Stock, &p.AvailableStock, &p.LowStockThreshold, &p.Currency, &p.Version, &t, &u, &p.CategoryID, &p.Category, &p.Tags); err != nil {
+		return Product{}, err
 	}
-	if body.Name == "" || body.PriceCents <= 0 || body.Stock < 0 {
-		http.Error(w, "invalid fields", http.StatusBadRequest)
-		return
+	if p.Tags == nil {
+		p.Tags = []string{}
 	}
+	p.CreatedAt = t.Format(time.RFC3339)
+	p.createdAt = t
+	p.UpdatedAt = u.Format(time.RFC3339)
+	p.updatedAt = u
+	p.SaleStartsAt = formatOptionalTime(saleStarts)
+	p.SaleEndsAt = formatOptionalTime(saleEnds)
+	p.setEffectivePrice(time.Now())
+	p.setDisplayPrice()
+	return p, nil
+}
 
-	id := uuid.New().String()
-	createdAt := time.Now().UTC()
-
-	if _, err := db.Exec(ctx,
-		`INSERT INTO products(id, name, price_cents, stock, created_at) VALUES($1,$2,$3,$4,$5)`,
-		id, body.Name, body.PriceCents, body.Stock, createdAt,
-	); err != nil {
-		http.Error(w, "insert error", http.StatusInternalServerError)
+func getProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ct, ok := negotiate(w, r)
+	if !ok {
 		return
 	}
-
-	// invalidate cache
-	if rdb != nil {
-		_ = rdb.Del(ctx, "products:all").Err()
+	p, err := scanProduct(db.QueryRow(r.Context(),
+		`SELECT `+productColumns+` FROM products`+productJoins+` WHERE id = $1::uuid AND deleted_at IS NULL`, id,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
 	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	setProductValidators(w, p)
+	if ct == contentXML {
+		writeXML(w, http.StatusOK, p)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func formatOptionalTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.UTC().Format(time.RFC3339)
+	return &s
+}
+
+// setProductValidators sets the ETag and Last-Modified of a single product.
+// The ETag stays the version rather than being derived from updated_at:
+// both change on every write, but the version is what If-Match takes back.
+func setProductValidators(w http.ResponseWriter, p Product) {
+	w.Header().Set("ETag", versionETag(p.Version))
+	w.Header().Set("Last-Modified", p.updatedAt.UTC().Format(http.TimeFormat))
+}
+
+// versionETag formats a product version as a strong ETag, the form PUT and
+// PATCH accept back in If-Match.
+func versionETag(v int) string {
+	return `"` + strconv.Itoa(v) + `"`
+}
+
+// expectedVersion returns the version a PUT/PATCH is conditioned on, taken
+// from If-Match or the body's version field. If neither is given, they
+// disagree or If-Match is malformed it writes the error response and
+// returns ok=false.
+func expectedVersion(w http.ResponseWriter, r *http.Request, bodyVersion *int) (int, bool) {
+	hv := -1
+	if h := r.Header.Get("If-Match"); h != "" {
+		n, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "If-Match must be a product version")
+			return 0, false
+		}
+		hv = n
+	}
+	switch {
+	case hv < 0 && bodyVersion == nil:
+		writeError(w, http.StatusPreconditionRequired, codePreconditionRequired, "If-Match header or version field required")
+		return 0, false
+	case hv >= 0 && bodyVersion != nil && hv != *bodyVersion:
+		writeError(w, http.StatusBadRequest, codeBadRequest, "If-Match and version disagree")
+		return 0, false
+	case hv >= 0:
+		return hv, true
+	}
+	return *bodyVersion, true
+}
+
+// productDeleted reports whether id is a soft-deleted product. It is used
+// to tell "gone" apart from a failed condition after an UPDATE matched no
+// row.
+func productDeleted(ctx context.Context, id string) bool {
+	var deleted bool
+	err := db.QueryRow(ctx, `SELECT deleted_at IS NOT NULL FROM products WHERE id = $1::uuid`, id).Scan(&deleted)
+	return err == nil && deleted
+}
+
+func updateProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+
+	var body createBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	version, ok := expectedVersion(w, r, body.Version)
+	if !ok {
+		return
+	}
+
+	p, err := updateWithAuditTx(ctx, id, auditUpdate, tagsUpdater(body.Tags),
+		`UPDATE products SET name = $2, price_cents = $3, stock = $4, currency = $5, category_id = $7, description = $8, image_url = $9, sku = $10, low_stock_threshold = $11, sale_price_cents = $12, sale_starts_at = $13, sale_ends_at = $14, version = version + 1, updated_at = now()
+		 WHERE id = $1::uuid AND deleted_at IS NULL AND version = $6`,
+		id, body.Name, body.PriceCents, body.Stock, body.Currency, version, body.CategoryID, body.Description, body.ImageURL, body.SKU, body.LowStockThreshold, body.SalePriceCents, body.SaleStartsAt, body.SaleEndsAt,
+	)
+	if errors.Is(err, errProductMissing) || (errors.Is(err, pgx.ErrNoRows) && productDeleted(ctx, id)) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusPreconditionFailed, codePreconditionFailed, "version mismatch; reload the product and retry")
+		return
+	}
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, codeConflict, productConflict(err))
+		return
+	}
+	if isForeignKeyViolation(err) {
+		writeFieldErrors(w, fieldErrors{"categoryId": "unknown category"})
+		return
+	}
+	if errs := saleViolation(err); errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "update error")
+		return
+	}
+
+	// invalidate cache
+	invalidateProduct(ctx, eventUpdated, p)
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+func deleteProduct(w http.ResponseWriter, r *http.Request, id string) {
+	// soft delete (idempotent: an already-deleted row keeps its deleted_at)
+	_, err := updateWithAudit(r.Context(), id, auditDelete,
+		`UPDATE products SET deleted_at = now(), version = version + 1, updated_at = now() WHERE id = $1::uuid AND deleted_at IS NULL`, id,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	// invalidate cache
+	invalidateProducts(r.Context(), eventDeleted, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreProduct undoes a soft delete. Restoring a live product is a no-op
+// that still returns it.
+func restoreProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	p, err := updateWithAudit(ctx, id, auditRestore,
+		`UPDATE products SET deleted_at = NULL, version = version + 1, updated_at = now() WHERE id = $1::uuid AND deleted_at IS NOT NULL`, id,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// missing (404) or not deleted (returned as-is)
+		getProduct(w, r, id)
+		return
+	}
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, codeConflict, productConflict(err))
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	invalidateProduct(ctx, eventUpdated, p)
+	writeJSON(w, http.StatusOK, p)
+}
+
+type purchaseBody struct {
+	Quantity int `json:"quantity"`
+}
+
+// purchaseProduct atomically takes quantity units out of stock. The
+// conditional UPDATE makes concurrent purchases unable to oversell, and
+// units held by reservations aren't for sale.
+func purchaseProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+
+	var body purchaseBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Quantity <= 0 || body.Quantity > maxQuantity {
+		writeFieldErrors(w, fieldErrors{"quantity": quantityInvalid})
+		return
+	}
+
+	p, err := updateWithAudit(ctx, id, auditPurchase,
+		`UPDATE products SET stock = stock - $2, version = version + 1, updated_at = now() WHERE id = $1::uuid AND deleted_at IS NULL AND `+availableStockExpr+` >= $2`,
+		id, body.Quantity,
+	)
+	if errors.Is(err, errProductMissing) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		// row exists but is deleted or short on stock; report deleted as missing
+		if productDeleted(ctx, id) {
+			writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+			return
+		}
+		writeError(w, http.StatusConflict, codeInsufficientStock, "insufficient stock")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	// invalidate cache
+	invalidateProduct(ctx, eventUpdated, p)
+
+	writeJSON(w, http.StatusOK, map[string]any{"id": p.ID, "stock": p.Stock})
+}
+
+type stockBody struct {
+	Delta int `json:"delta"`
+}
+
+// adjustStock serves PATCH /products/:id/stock, adding delta (negative to
+// remove) to the current stock in one conditional UPDATE, so concurrent
+// scanners can't race each other or drive stock below zero. Units held by
+// reservations can't be removed either, as with purchaseProduct.
+func adjustStock(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+
+	var body stockBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Delta == 0 {
+		writeFieldErrors(w, fieldErrors{"delta": "must not be 0"})
+		return
+	}
+
+	p, err := updateWithAudit(ctx, id, auditStock,
+		`UPDATE products SET stock = stock + $2, version = version + 1, updated_at = now() WHERE id = $1::uuid AND deleted_at IS NULL AND `+availableStockExpr+` + $2 >= 0`,
+		id, body.Delta,
+	)
+	if errors.Is(err, errProductMissing) || (errors.Is(err, pgx.ErrNoRows) && productDeleted(ctx, id)) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusConflict, codeInsufficientStock, "stock cannot go below zero or the reserved quantity")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	// invalidate cache
+	invalidateProduct(ctx, eventUpdated, p)
+
+	writeJSON(w, http.StatusOK, map[string]any{"id": p.ID, "stock": p.Stock})
+}
+
+func patchProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+
+	var body patchBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	// only SET the columns that were provided
+	sets := make([]string, 0, 4)
+	args := []any{id}
+	add := func(col string, v any) {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
+	if body.Name != nil {
+		add("name", *body.Name)
+	}
+	if body.SKU != nil {
+		if *body.SKU == "" {
+			add("sku", nil)
+		} else {
+			add("sku", *body.SKU)
+		}
+	}
+	if body.Description != nil {
+		add("description", *body.Description)
+	}
+	if body.ImageURL != nil {
+		if *body.ImageURL == "" {
+			add("image_url", nil)
+		} else {
+			add("image_url", *body.ImageURL)
+		}
+	}
+	if body.PriceCents != nil {
+		add("price_cents", *body.PriceCents)
+	}
+	if body.SalePriceCents != nil {
+		if *body.SalePriceCents == 0 {
+			add("sale_price_cents", nil)
+		} else {
+			add("sale_price_cents", *body.SalePriceCents)
+		}
+	}
+	for _, st := range []struct {
+		col string
+		v   *string
+	}{{"sale_starts_at", body.SaleStartsAt}, {"sale_ends_at", body.SaleEndsAt}} {
+		if st.v == nil {
+			continue
+		}
+		if *st.v == "" {
+			add(st.col, nil)
+		} else {
+			add(st.col, *st.v)
+		}
+	}
+	if body.Stock != nil {
+		add("stock", *body.Stock)
+	}
+	if body.LowStockThreshold != nil {
+		add("low_stock_threshold", *body.LowStockThreshold)
+	}
+	if body.Currency != nil {
+		add("currency", *body.Currency)
+	}
+	if body.CategoryID != nil {
+		add("category_id", *body.CategoryID)
+	}
+	if len(sets) == 0 && body.Tags == nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "no fields to update")
+		return
+	}
+	version, ok := expectedVersion(w, r, body.Version)
+	if !ok {
+		return
+	}
+	args = append(args, version)
+
+	sets = append(sets, "version = version + 1", "updated_at = now()")
+	p, err := updateWithAuditTx(ctx, id, auditUpdate, tagsUpdater(body.Tags),
+		`UPDATE products SET `+strings.Join(sets, ", ")+`
+		 WHERE id = $1::uuid AND deleted_at IS NULL AND version = $`+strconv.Itoa(len(args)),
+		args...,
+	)
+	if errors.Is(err, errProductMissing) || (errors.Is(err, pgx.ErrNoRows) && productDeleted(ctx, id)) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusPreconditionFailed, codePreconditionFailed, "version mismatch; reload the product and retry")
+		return
+	}
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, codeConflict, productConflict(err))
+		return
+	}
+	if isForeignKeyViolation(err) {
+		writeFieldErrors(w, fieldErrors{"categoryId": "unknown category"})
+		return
+	}
+	if errs := saleViolation(err); errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "update error")
+		return
+	}
+
+	// invalidate cache
+	invalidateProduct(ctx, eventUpdated, p)
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// sortOrders whitelists the ?sort= values; the raw value never reaches SQL.
+// id is a tie-breaker so paging over equal keys is stable.
+var sortOrders = map[string]string{
+	"created_desc": "created_at DESC, id DESC",
+	"created_asc":  "created_at ASC, id ASC",
+	"price_asc":    "price_cents ASC, id ASC",
+	"price_desc":   "price_cents DESC, id DESC",
+	"name_asc":     "name ASC, id ASC",
+	"name_desc":    "name DESC, id DESC",
+}
+
+const defaultSort = "created_desc"
+
+// relevanceSort orders ?search= results by ts_rank. It is the default when
+// searching and isn't valid otherwise, so it lives outside sortOrders.
+const relevanceSort = "relevance"
+
+// searchQuery is the tsquery of ?search=; websearch syntax ("quoted
+// phrases", -exclusions, or) never raises a syntax error on user input.
+const searchQuery = "websearch_to_tsquery('english', ?)"
+
+// listParams holds the parsed query string of GET /products.
+type listParams struct {
+	Limit  int
+	Offset int
+	Cursor *listCursor
+	Query  string // name substring, case-insensitive
+	// price bounds in cents, inclusive; nil when unset
+	MinPrice   *int
+	MaxPrice   *int
+	Sort       string // key of sortOrders
+	InStock    bool   // only stock > 0
+	OutOfStock bool   // only stock = 0
+	Category   string // category id or (case-insensitive) name
+	Tag        string // normalized tag name
+	Search     string // full-text query, matched against search_vector
+	// creation bounds, inclusive; nil when unset
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// keyset reports whether the sort order supports cursor pagination.
+func (lp listParams) keyset() bool {
+	return lp.Sort == "created_desc" || lp.Sort == "created_asc"
+}
+
+// listCursor marks the last row of a page for keyset pagination.
+type listCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c listCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	ts, id, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return nil, errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, err
+	}
+	return &listCursor{CreatedAt: t, ID: id}, nil
+}
+
+// sqlWhere accumulates AND-ed conditions and their positional args.
+type sqlWhere struct {
+	conds []string
+	args  []any
+}
+
+// add appends cond, replacing each "?" with the next $n placeholder.
+func (sw *sqlWhere) add(cond string, args ...any) {
+	sw.conds = append(sw.conds, sw.expr(cond, args...))
+}
+
+// expr is add for expressions outside the WHERE clause (e.g. ORDER BY): it
+// binds args and returns the expression instead of appending it.
+func (sw *sqlWhere) expr(e string, args ...any) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range e {
+		if c == '?' && n < len(args) {
+			sw.args = append(sw.args, args[n])
+			n++
+			fmt.Fprintf(&b, "$%d", len(sw.args))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// arg appends a bare argument (e.g. for LIMIT) and returns its placeholder.
+func (sw *sqlWhere) arg(v any) string {
+	sw.args = append(sw.args, v)
+	return fmt.Sprintf("$%d", len(sw.args))
+}
+
+func (sw *sqlWhere) String() string {
+	if len(sw.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(sw.conds, " AND ")
+}
+
+func parseListParams(r *http.Request) (listParams, error) {
+	q := r.URL.Query()
+	lp := listParams{Limit: defaultListLimit, Sort: defaultSort}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return lp, errors.New("limit must be a positive integer")
+		}
+		lp.Limit = min(n, maxListLimit)
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return lp, errors.New("offset must be a non-negative integer")
+		}
+		lp.Offset = n
+	}
+	lp.Query = strings.TrimSpace(q.Get("q"))
+	for _, pb := range []struct {
+		name string
+		dst  **int
+	}{{"minPrice", &lp.MinPrice}, {"maxPrice", &lp.MaxPrice}} {
+		v := q.Get(pb.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return lp, fmt.Errorf("%s must be a non-negative integer", pb.name)
+		}
+		*pb.dst = &n
+	}
+	if lp.MinPrice != nil && lp.MaxPrice != nil && *lp.MinPrice > *lp.MaxPrice {
+		return lp, errors.New("minPrice must be <= maxPrice")
+	}
+	switch q.Get("inStock") {
+	case "", "false":
+	case "true":
+		lp.InStock = true
+	default:
+		return lp, errors.New(`inStock must be "true" or "false"`)
+	}
+	switch q.Get("outOfStock") {
+	case "", "false":
+	case "true":
+		lp.OutOfStock = true
+	default:
+		return lp, errors.New(`outOfStock must be "true" or "false"`)
+	}
+	if lp.InStock && lp.OutOfStock {
+		return lp, errors.New("inStock and outOfStock cannot be combined")
+	}
+	for _, tb := range []struct {
+		name string
+		dst  **time.Time
+	}{{"createdAfter", &lp.CreatedAfter}, {"createdBefore", &lp.CreatedBefore}} {
+		v := q.Get(tb.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return lp, fmt.Errorf("%s must be an RFC 3339 timestamp", tb.name)
+		}
+		t = t.UTC()
+		*tb.dst = &t
+	}
+	if lp.CreatedAfter != nil && lp.CreatedBefore != nil && lp.CreatedAfter.After(*lp.CreatedBefore) {
+		return lp, errors.New("createdAfter must be <= createdBefore")
+	}
+	lp.Category = strings.TrimSpace(q.Get("category"))
+	lp.Tag = strings.ToLower(strings.TrimSpace(q.Get("tag")))
+	// a blank search is no search, so an emptied search bar lists everything
+	lp.Search = strings.TrimSpace(q.Get("search"))
+	if lp.Search != "" {
+		lp.Sort = relevanceSort
+	}
+	if v := q.Get("sort"); v != "" {
+		if _, ok := sortOrders[v]; !ok && (v != relevanceSort || lp.Search == "") {
+			return lp, errors.New("invalid sort")
+		}
+		lp.Sort = v
+	}
+	if v := q.Get("cursor"); v != "" {
+		if lp.Offset != 0 {
+			return lp, errors.New("cursor and offset cannot be combined")
+		}
+		if !lp.keyset() {
+			return lp, errors.New("cursor requires a created_* sort")
+		}
+		c, err := decodeCursor(v)
+		if err != nil {
+			return lp, errors.New("invalid cursor")
+		}
+		lp.Cursor = c
+	}
+	return lp, nil
+}
+
+// cacheKey is unique per page so paginated responses never collide.
+// listCacheGet turns it into the full key.
+func (lp listParams) cacheKey() string {
+	k := fmt.Sprintf("limit=%d:offset=%d:sort=%s", lp.Limit, lp.Offset, lp.Sort)
+	if lp.Cursor != nil {
+		k += ":cursor=" + lp.Cursor.encode()
+	}
+	return k + lp.filterKey()
+}
+
+// filterKey encodes the row filters for cache keys.
+func (lp listParams) filterKey() string {
+	var k string
+	if lp.Query != "" {
+		k += ":q=" + url.QueryEscape(lp.Query)
+	}
+	if lp.MinPrice != nil {
+		k += fmt.Sprintf(":minPrice=%d", *lp.MinPrice)
+	}
+	if lp.MaxPrice != nil {
+		k += fmt.Sprintf(":maxPrice=%d", *lp.MaxPrice)
+	}
+	if lp.InStock {
+		k += ":inStock=true"
+	}
+	if lp.OutOfStock {
+		k += ":outOfStock=true"
+	}
+	if lp.Category != "" {
+		k += ":category=" + url.QueryEscape(lp.Category)
+	}
+	if lp.Tag != "" {
+		k += ":tag=" + url.QueryEscape(lp.Tag)
+	}
+	if lp.Search != "" {
+		k += ":search=" + url.QueryEscape(lp.Search)
+	}
+	if lp.CreatedAfter != nil {
+		k += ":createdAfter=" + lp.CreatedAfter.Format(time.RFC3339Nano)
+	}
+	if lp.CreatedBefore != nil {
+		k += ":createdBefore=" + lp.CreatedBefore.Format(time.RFC3339Nano)
+	}
+	return k
+}
+
+// filtered reports whether any row filter is set.
+func (lp listParams) filtered() bool {
+	return lp.Query != "" || lp.MinPrice != nil || lp.MaxPrice != nil || lp.InStock || lp.OutOfStock ||
+		lp.Category != "" || lp.Tag != "" || lp.Search != "" || lp.CreatedAfter != nil || lp.CreatedBefore != nil
+}
+
+// isDefault reports whether lp is the plain first page of the catalogue:
+// no filters, the default limit and sort, and no offset or cursor.
+func (lp listParams) isDefault() bool {
+	return !lp.filtered() && lp.Limit == defaultListLimit && lp.Offset == 0 && lp.Sort == defaultSort && lp.Cursor == nil
+}
+
+// applyFilters adds the row filters (everything except paging) to sw.
+// Soft-deleted rows are always excluded. The conditions may reference
+// category_name, so the query must include categoryJoin.
+func (lp listParams) applyFilters(sw *sqlWhere) {
+	sw.add("deleted_at IS NULL")
+	if lp.Query != "" {
+		sw.add("name ILIKE '%' || ? || '%'", lp.Query)
+	}
+	if lp.MinPrice != nil {
+		sw.add("price_cents >= ?", *lp.MinPrice)
+	}
+	if lp.MaxPrice != nil {
+		sw.add("price_cents <= ?", *lp.MaxPrice)
+	}
+	if lp.InStock {
+		sw.add("stock > 0")
+	}
+	if lp.OutOfStock {
+		sw.add("stock = 0")
+	}
+	if lp.CreatedAfter != nil {
+		sw.add("created_at >= ?", *lp.CreatedAfter)
+	}
+	if lp.CreatedBefore != nil {
+		sw.add("created_at <= ?", *lp.CreatedBefore)
+	}
+	if lp.Category != "" {
+		if uuid.Validate(lp.Category) == nil {
+			sw.add("category_id = ?::uuid", lp.Category)
+		} else {
+			sw.add("lower(category_name) = lower(?)", lp.Category)
+		}
+	}
+	if lp.Search != "" {
+		sw.add("search_vector @@ "+searchQuery, lp.Search)
+	}
+	if lp.Tag != "" {
+		sw.add("EXISTS (SELECT 1 FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.product_id = products.id AND t.name = ?)", lp.Tag)
+	}
+}
+
+// orderBy returns the ORDER BY expression for lp.Sort, adding any argument
+// it needs to sw.
+func (lp listParams) orderBy(sw *sqlWhere) string {
+	if lp.Sort == relevanceSort {
+		return sw.expr("ts_rank(search_vector, "+searchQuery+") DESC, id DESC", lp.Search)
+	}
+	return sortOrders[lp.Sort]
+}
+
+// productList is the response body of GET /products.
+type productList struct {
+	XMLName xml.Name  `json:"-" xml:"products"`
+	Items   []Product `json:"items" xml:"product"`
+	Total   int       `json:"total" xml:"total,attr"`
+	Limit   int       `json:"limit" xml:"limit,attr"`
+	Offset  int       `json:"offset" xml:"offset,attr"`
+	// NextCursor is empty on the last page, and always empty for sorts
+	// other than created_*; page those with offset instead.
+	NextCursor string `json:"nextCursor" xml:"nextCursor,attr,omitempty"`
+}
+
+// writeWithETag writes the payload b of type contentType with an ETag hashed from it and,
+// unless lastModified is zero, a Last-Modified header. It writes a bodyless
+// 304 instead when the client's If-None-Match already has that ETag, or,
+// absent If-None-Match, when nothing is newer than If-Modified-Since.
+func writeWithETag(w http.ResponseWriter, r *http.Request, contentType string, b []byte, lastModified time.Time) {
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) || notModifiedSince(r, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	// set here so HEAD reports it too; withGzip drops it when compressing
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// notModifiedSince reports whether r's If-Modified-Since covers
+// lastModified. As RFC 9110 requires, it is ignored when If-None-Match is
+// present, since the ETag is the more precise validator.
+func notModifiedSince(r *http.Request, lastModified time.Time) bool {
+	if lastModified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	// HTTP dates have whole seconds
+	return err == nil && !lastModified.Truncate(time.Second).After(since)
+}
+
+// listLastModified returns the newest updated_at among items, or zero for
+// an empty list. It reads the JSON field so it works on cached pages too.
+// A delete drops its row from the list without advancing this, so clients
+// that need to see deletions promptly should revalidate with the ETag.
+func listLastModified(items []Product) time.Time {
+	var t time.Time
+	for _, p := range items {
+		if u, err := time.Parse(time.RFC3339, p.UpdatedAt); err == nil && u.After(t) {
+			t = u
+		}
+	}
+	return t
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 prescribes for it.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func getProducts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	lp, err := parseListParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	ct, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+	// only the default first page is cached: every filter, sort and page
+	// would be a key of its own, mostly never read again
+	if !lp.isDefault() {
+		if rdb != nil {
+			productsCache.WithLabelValues("bypass").Inc()
+		}
+		streamProductList(w, r, ct, lp)
+		return
+	}
+
+	// 1) try cache
+	s, key, ok := listCacheGet(ctx, lp.cacheKey())
+	if ok {
+		productsCache.WithLabelValues("hit").Inc()
+		var list productList
+		json.Unmarshal([]byte(s), &list)
+		writeProductList(w, r, ct, listPage{body: []byte(s), lastModified: listLastModified(list.Items)})
+		return
+	}
+	if rdb != nil {
+		productsCache.WithLabelValues("miss").Inc()
+	}
+
+	// 2) query DB, once for all concurrent misses on key; the flight gets
+	// its own deadline so one caller going away doesn't fail the others.
+	// The page is buffered for the ETag and the cache until it outgrows
+	// listCacheMaxBytes; a bigger JSON page then streams to the caller
+	// running the flight, and the others query for themselves
+	var pb *pageBuffer
+	v, err, _ := listFlight.Do(key.String(), func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+		defer cancel()
+		pb = &pageBuffer{max: listCacheMaxBytes}
+		if ct == contentJSON {
+			pb.w, pb.contentType = w, ct
+		}
+		start := time.Now()
+		lastModified, err := queryProductList(ctx, lp, pb)
+		if err != nil {
+			return nil, err
+		}
+		slog.DebugContext(ctx, "product list queried", "key", key.String(), "elapsed", time.Since(start), "bytes", pb.n, "streamed", pb.spilled)
+		if pb.spilled {
+			return listPage{}, nil
+		}
+		page := listPage{body: pb.buf.Bytes(), lastModified: lastModified}
+		// an XML page is buffered whole, however big, but cached only if small
+		if len(page.body) <= listCacheMaxBytes {
+			if err := listCacheSet(ctx, key, page.body, productsCacheTTL); err != nil {
+				productsCachePopulateFailures.Inc()
+			}
+		}
+		return page, nil
+	})
+	switch page, _ := v.(listPage); {
+	case pb != nil && pb.spilled:
+		// this request ran the flight and has already been answered
+		if err != nil {
+			slog.WarnContext(ctx, "product list stream failed", "err", err)
+		}
+	case err != nil:
+		writeDBError(w, err, "db error")
+	case page.body == nil:
+		streamProductList(w, r, ct, lp)
+	default:
+		// 3) write response
+		writeProductList(w, r, ct, page)
+	}
+}
+
+// streamProductList answers a list request that isn't cached. Pages up to
+// listCacheMaxBytes are buffered and written with their validators; a
+// bigger JSON page streams to w as rows are read, and without the whole
+// body up front it has no ETag, Last-Modified or Content-Length. XML is
+// always buffered: its root element carries nextCursor, which is known
+// only after the last row.
+func streamProductList(w http.ResponseWriter, r *http.Request, contentType string, lp listParams) {
+	pb := &pageBuffer{max: listCacheMaxBytes}
+	if contentType == contentJSON {
+		pb.w, pb.contentType = w, contentType
+	}
+	lastModified, err := queryProductList(r.Context(), lp, pb)
+	switch {
+	case err != nil && pb.spilled:
+		// headers are already sent, so the response can only be truncated
+		slog.WarnContext(r.Context(), "product list stream failed", "err", err)
+	case err != nil:
+		writeDBError(w, err, "db error")
+	case !pb.spilled:
+		writeProductList(w, r, contentType, listPage{body: pb.buf.Bytes(), lastModified: lastModified})
+	}
+}
+
+// pageBuffer is where queryProductList renders a page. It buffers up to max
+// bytes; past that, if w is set, it spills: the Content-Type header and the
+// bytes so far go to w, and the rest streams straight there. With w unset
+// it buffers everything.
+type pageBuffer struct {
+	buf         bytes.Buffer
+	max         int
+	w           http.ResponseWriter
+	contentType string
+	spilled     bool
+	n           int // bytes written in all
+}
+
+func (pb *pageBuffer) Write(p []byte) (int, error) {
+	pb.n += len(p)
+	if !pb.spilled && pb.w != nil && pb.buf.Len()+len(p) > pb.max {
+		pb.spilled = true
+		pb.w.Header().Set("Content-Type", pb.contentType)
+		if _, err := pb.w.Write(pb.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		pb.buf = bytes.Buffer{}
+	}
+	if pb.spilled {
+		return pb.w.Write(p)
+	}
+	return pb.buf.Write(p)
+}
+
+// writeProductList writes page as contentType. Pages are rendered as JSON,
+// so XML is encoded per request from the decoded list.
+func writeProductList(w http.ResponseWriter, r *http.Request, contentType string, page listPage) {
+	b := page.body
+	if contentType == contentXML {
+		var list productList
+		err := json.Unmarshal(b, &list)
+		if err == nil {
+			b, err = marshalXML(list)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "encode error")
+			return
+		}
+		contentType += "; charset=utf-8"
+	}
+	writeWithETag(w, r, contentType, b, page.lastModified)
+}
+
+// listFlight collapses concurrent cache misses for the same list key into a
+// single DB query, so an expiring hot key doesn't stampede Postgres.
+var listFlight singleflight.Group
+
+// listPage is a rendered GET /products response shared through listFlight.
+// body is nil when the page was too big to share and was streamed instead.
+type listPage struct {
+	body         []byte    // JSON productList
+	lastModified time.Time // newest updated_at on the page
+}
+
+// queryProductList runs the count and page queries for lp and renders the
+// page as JSON to out, returning the newest updated_at on it. Rows are
+// encoded one at a time as they are read, so the page is never held as a
+// []Product. Nothing is written until the first row (or the end of an
+// empty page) has been read, so a failing query leaves out untouched.
+func queryProductList(ctx context.Context, lp listParams, out io.Writer) (time.Time, error) {
+	var cw sqlWhere
+	lp.applyFilters(&cw)
+	var total int
+	if err := db.QueryRow(ctx, `SELECT count(*) FROM products`+categoryJoin+cw.String(), cw.args...).Scan(&total); err != nil {
+		return time.Time{}, err
+	}
+	var sw sqlWhere
+	lp.applyFilters(&sw)
+	if lp.Cursor != nil {
+		cmp := "<"
+		if lp.Sort == "created_asc" {
+			cmp = ">"
+		}
+		sw.add("(created_at, id) "+cmp+" (?, ?::uuid)", lp.Cursor.CreatedAt, lp.Cursor.ID)
+	}
+	// fetch one extra row to know whether there is a next page
+	sql := `SELECT ` + productColumns + ` FROM products` + productJoins + sw.String() +
+		` ORDER BY ` + lp.orderBy(&sw) + ` LIMIT ` + sw.arg(lp.Limit+1) + ` OFFSET ` + sw.arg(lp.Offset)
+	rows, err := db.Query(ctx, sql, sw.args...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+
+	var lastModified time.Time
+	var item bytes.Buffer // one encoded row
+	enc := json.NewEncoder(&item)
+	var last Product
+	n, more := 0, false
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if n == lp.Limit {
+			more = true
+			break
+		}
+		item.Reset()
+		if n == 0 {
+			item.WriteString(`{"items":[`)
+		} else {
+			item.WriteByte(',')
+		}
+		if err := enc.Encode(p); err != nil {
+			return time.Time{}, err
+		}
+		if _, err := out.Write(item.Bytes()[:item.Len()-1]); err != nil { // less Encode's newline
+			return time.Time{}, err
+		}
+		if p.updatedAt.After(lastModified) {
+			lastModified = p.updatedAt
+		}
+		last, n = p, n+1
+	}
+	if err := rows.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	var next string
+	if more && lp.keyset() {
+		next = listCursor{CreatedAt: last.createdAt, ID: last.ID}.encode()
+	}
+	// the productList fields after items
+	tail, err := json.Marshal(struct {
+		Total      int    `json:"total"`
+		Limit      int    `json:"limit"`
+		Offset     int    `json:"offset"`
+		NextCursor string `json:"nextCursor"`
+	}{total, lp.Limit, lp.Offset, next})
+	if err != nil {
+		return time.Time{}, err
+	}
+	item.Reset()
+	if n == 0 {
+		item.WriteString(`{"items":[`)
+	}
+	item.WriteString("],")
+	item.Write(tail[1:]) // drop the opening brace
+	_, err = out.Write(item.Bytes())
+	return lastModified, err
+}
+
+// countCacheTTL is short: counts are cheap to recompute and a dashboard
+// polling them wants fresh numbers.
+const countCacheTTL = 10 * time.Second
+
+// getProductsCount serves GET /products/count with the list filters. Its
+// cache key is a listCacheKey, so invalidateProducts drops it with the lists.
+func getProductsCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+
+	lp, err := parseListParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	s, key, ok := listCacheGet(ctx, "count"+lp.filterKey())
+	if ok {
+		productsCache.WithLabelValues("hit").Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(s))
+		return
+	}
+	if rdb != nil {
+		productsCache.WithLabelValues("miss").Inc()
+	}
+
+	var sw sqlWhere
+	lp.applyFilters(&sw)
+	var n int
+	if err := db.QueryRow(ctx, `SELECT count(*) FROM products`+categoryJoin+sw.String(), sw.args...).Scan(&n); err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	b, _ := json.Marshal(map[string]int{"count": n})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	if err := listCacheSet(ctx, key, b, countCacheTTL); err != nil {
+		productsCachePopulateFailures.Inc()
+	}
+}
+
+// patchBody uses pointers so an omitted field can be told apart from one
+// explicitly set to its zero value.
+type patchBody struct {
+	Name              *string  `json:"name"`
+	SKU               *string  `json:"sku"` // "" clears it unless SKU_REQUIRED
+	Description       *string  `json:"description"`
+	ImageURL          *string  `json:"imageUrl"` // "" clears it
+	PriceCents        *int     `json:"priceCents"`
+	SalePriceCents    *int     `json:"salePriceCents"` // 0 ends the sale
+	SaleStartsAt      *string  `json:"saleStartsAt"`   // "" clears it
+	SaleEndsAt        *string  `json:"saleEndsAt"`     // "" clears it
+	Stock             *int     `json:"stock"`
+	LowStockThreshold *int     `json:"lowStockThreshold"` // clear it with PUT
+	Currency          *string  `json:"currency"`
+	CategoryID        *string  `json:"categoryId"`
+	Tags              []string `json:"tags"`    // replaces all tags; nil when omitted
+	Version           *int     `json:"version"` // alternative to If-Match
+}
+
+func (b *patchBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	if b.Name != nil {
+		name := normalizeName(*b.Name)
+		b.Name = &name
+		if msg := nameInvalid(name); msg != "" {
+			errs["name"] = msg
+		}
+	}
+	if b.SKU != nil {
+		if *b.SKU == "" {
+			if skuRequired {
+				errs["sku"] = "must not be empty"
+			}
+		} else if sku, msg := normalizeSKU(*b.SKU); msg != "" {
+			errs["sku"] = msg
+		} else {
+			b.SKU = &sku
+		}
+	}
+	if b.Description != nil && utf8.RuneCountInString(*b.Description) > maxDescriptionLength {
+		errs["description"] = descriptionTooLong
+	}
+	if b.ImageURL != nil && *b.ImageURL != "" && !validHTTPURL(*b.ImageURL) {
+		errs["imageUrl"] = imageURLInvalid
+	}
+	if b.PriceCents != nil && (*b.PriceCents <= 0 || *b.PriceCents > maxPriceCents) {
+		errs["priceCents"] = priceInvalid()
+	}
+	// against the stored price and bounds, the table's constraints check
+	if b.SalePriceCents != nil && (*b.SalePriceCents < 0 || b.PriceCents != nil && *b.SalePriceCents >= *b.PriceCents) {
+		errs["salePriceCents"] = salePriceInvalid
+	}
+	validateSaleWindow(errs, &b.SaleStartsAt, &b.SaleEndsAt)
+	if b.Stock != nil && *b.Stock < 0 {
+		errs["stock"] = "must be >= 0"
+	}
+	if b.LowStockThreshold != nil && *b.LowStockThreshold < 0 {
+		errs["lowStockThreshold"] = "must be >= 0"
+	}
+	if b.Currency != nil {
+		if _, ok := currencies[*b.Currency]; !ok {
+			errs["currency"] = "unsupported currency"
+		}
+	}
+	if b.CategoryID != nil && uuid.Validate(*b.CategoryID) != nil {
+		errs["categoryId"] = "must be a UUID"
+	}
+	if b.Tags != nil {
+		var msg string
+		if b.Tags, msg = normalizeTags(b.Tags); msg != "" {
+			errs["tags"] = msg
+		}
+	}
+	return errs
+}
+
+type createBody struct {
+	Name              string   `json:"name"`
+	SKU               *string  `json:"sku"`         // optional unless SKU_REQUIRED; stored upper-cased
+	Description       *string  `json:"description"` // optional; PUT with null clears it
+	ImageURL          *string  `json:"imageUrl"`    // optional http(s) URL; null or "" means none
+	PriceCents        int      `json:"priceCents"`
+	Price             *string  `json:"price"`          // optional decimal alternative to priceCents, e.g. "12.99"
+	SalePriceCents    *int     `json:"salePriceCents"` // optional; PUT with null ends the sale
+	SaleStartsAt      *string  `json:"saleStartsAt"`   // optional RFC 3339; null means already started
+	SaleEndsAt        *string  `json:"saleEndsAt"`     // optional RFC 3339; null means open-ended
+	Stock             int      `json:"stock"`
+	LowStockThreshold *int     `json:"lowStockThreshold"` // optional; null disables alerts
+	Currency          string   `json:"currency"`          // ISO 4217, defaults to defaultCurrency
+	CategoryID        *string  `json:"categoryId"`        // optional; PUT with null uncategorises
+	Tags              []string `json:"tags"`              // optional; on PUT, omitting keeps the current tags
+	Version           *int     `json:"version"`           // PUT only, alternative to If-Match
+}
+
+// maxPriceCents caps priceCents (MAX_PRICE_CENTS), so a fat-fingered price
+// is rejected rather than sold.
+var maxPriceCents = 100_000_000
+
+func priceInvalid() string {
+	return fmt.Sprintf("must be > 0 and at most %d", maxPriceCents)
+}
+
+// maxQuantity is the most units a purchase, reservation or cart or order
+// line may ask for: the range of the stock column.
+const maxQuantity = math.MaxInt32
+
+var quantityInvalid = fmt.Sprintf("must be between 1 and %d", maxQuantity)
+
+// lineTotal is quantity units at unitCents each, or ok=false if that
+// overflows int.
+func lineTotal(unitCents, quantity int) (total int, ok bool) {
+	if quantity != 0 && unitCents > math.MaxInt/quantity {
+		return 0, false
+	}
+	return unitCents * quantity, true
+}
+
+// normalizeName trims a product name and collapses each run of inner
+// whitespace to one space, so names differing only in spacing clash on the
+// unique name index.
+func normalizeName(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// maxNameLength caps names, in characters (PRODUCT_NAME_MAX_LENGTH).
+var maxNameLength = 200
+
+// nameInvalid checks a normalized name, returning "" if it is acceptable.
+// Create, PUT, PATCH, bulk and import all validate names with it.
+func nameInvalid(name string) string {
+	if name == "" {
+		return "must not be empty"
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Sprintf("must be at most %d characters", maxNameLength)
+	}
+	return ""
+}
+
+// maxDescriptionLength caps descriptions, in characters.
+const maxDescriptionLength = 5000
+
+var descriptionTooLong = fmt.Sprintf("must be at most %d characters", maxDescriptionLength)
+
+const imageURLInvalid = "must be an absolute http or https URL"
+
+// validHTTPURL reports whether s is an absolute http(s) URL with a host.
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validate checks b and fills in defaults for omitted optional fields.
+func (b *createBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	b.Name = normalizeName(b.Name)
+	if b.Name == "" {
+		errs["name"] = "required"
+	} else if msg := nameInvalid(b.Name); msg != "" {
+		errs["name"] = msg
+	}
+	if b.SKU != nil && *b.SKU == "" {
+		b.SKU = nil
+	}
+	if b.SKU == nil {
+		if skuRequired {
+			errs["sku"] = "required"
+		}
+	} else if sku, msg := normalizeSKU(*b.SKU); msg != "" {
+		errs["sku"] = msg
+	} else {
+		b.SKU = &sku
+	}
+	if b.Description != nil && utf8.RuneCountInString(*b.Description) > maxDescriptionLength {
+		errs["description"] = descriptionTooLong
+	}
+	if b.ImageURL != nil && *b.ImageURL == "" {
+		b.ImageURL = nil
+	}
+	if b.ImageURL != nil && !validHTTPURL(*b.ImageURL) {
+		errs["imageUrl"] = imageURLInvalid
+	}
+	if b.Currency == "" {
+		b.Currency = defaultCurrency
+	}
+	if _, ok := currencies[b.Currency]; !ok {
+		errs["currency"] = "unsupported currency"
+	}
+	if b.Price != nil {
+		switch cents, ok := parseDecimalPrice(*b.Price, b.Currency); {
+		case !ok:
+			errs["price"] = decimalPriceInvalid(b.Currency)
+		case b.PriceCents == 0:
+			b.PriceCents = cents
+		case b.PriceCents != cents:
+			errs["price"] = "disagrees with priceCents"
+		}
+	}
+	if _, bad := errs["price"]; !bad && (b.PriceCents <= 0 || b.PriceCents > maxPriceCents) {
+		errs["priceCents"] = priceInvalid()
+	}
+	if b.SalePriceCents != nil && (*b.SalePriceCents <= 0 || *b.SalePriceCents >= b.PriceCents) {
+		errs["salePriceCents"] = salePriceInvalid
+	}
+	for _, v := range []**string{&b.SaleStartsAt, &b.SaleEndsAt} {
+		if *v != nil && **v == "" {
+			*v = nil
+		}
+	}
+	validateSaleWindow(errs, &b.SaleStartsAt, &b.SaleEndsAt)
+	if b.Stock < 0 {
+		errs["stock"] = "must be >= 0"
+	}
+	if b.LowStockThreshold != nil && *b.LowStockThreshold < 0 {
+		errs["lowStockThreshold"] = "must be >= 0"
+	}
+	if b.CategoryID != nil && uuid.Validate(*b.CategoryID) != nil {
+		errs["categoryId"] = "must be a UUID"
+	}
+	if b.Tags != nil {
+		var msg string
+		if b.Tags, msg = normalizeTags(b.Tags); msg != "" {
+			errs["tags"] = msg
+		}
+	}
+	return errs
+}
+
+// newProduct builds the Product a validated body is inserted as. categories
+// maps category ids to names, as returned by categoryNames.
+func newProduct(body createBody, categories map[string]string) Product {
+	createdAt := time.Now().UTC()
+	p := Product{
+		ID:                uuid.New().String(),
+		Name:              body.Name,
+		SKU:               body.SKU,
+		Description:       body.Description,
+		ImageURL:          body.ImageURL,
+		PriceCents:        body.PriceCents,
+		SalePriceCents:    body.SalePriceCents,
+		SaleStartsAt:      body.SaleStartsAt,
+		SaleEndsAt:        body.SaleEndsAt,
+		Stock:             body.Stock,
+		AvailableStock:    body.Stock,
+		LowStockThreshold: body.LowStockThreshold,
+		Currency:          body.Currency,
+		Version:           1,
+		CreatedAt:         createdAt.Format(time.RFC3339),
+		UpdatedAt:         createdAt.Format(time.RFC3339),
+		CategoryID:        body.CategoryID,
+		Tags:              body.Tags,
+		createdAt:         createdAt,
+		updatedAt:         createdAt,
+	}
+	if p.Tags == nil {
+		p.Tags = []string{}
+	}
+	p.setEffectivePrice(createdAt)
+	p.setDisplayPrice()
+	if body.CategoryID != nil {
+		name := categories[*body.CategoryID]
+		p.Category = &name
+	}
+	return p
+}
+
+// dryRunRequested reports whether a write asks to be validated only, with
+// ?dryRun=true or X-Dry-Run: true.
+func dryRunRequested(r *http.Request) (bool, error) {
+	for _, v := range []string{r.URL.Query().Get("dryRun"), r.Header.Get("X-Dry-Run")} {
+		switch v {
+		case "", "false":
+		case "true":
+			return true, nil
+		default:
+			return false, errors.New(`dryRun must be "true" or "false"`)
+		}
+	}
+	return false, nil
+}
+
+// insertProductSQL inserts the columns of a newProduct, in insertArgs order.
+const insertProductSQL = `INSERT INTO products(id, name, price_cents, stock, currency, created_at, updated_at, category_id, description, image_url, sku, low_stock_threshold, sale_price_cents, sale_starts_at, sale_ends_at) VALUES($1,$2,$3,$4,$5,$6,$6,$7,$8,$9,$10,$11,$12,$13,$14)`
+
+func insertArgs(p Product) []any {
+	return []any{p.ID, p.Name, p.PriceCents, p.Stock, p.Currency, p.createdAt, p.CategoryID, p.Description, p.ImageURL, p.SKU, p.LowStockThreshold, p.SalePriceCents, p.SaleStartsAt, p.SaleEndsAt}
+}
+
+// insertProduct inserts a validated product and its audit row within tx. It
+// returns errUnknownCategory if body references a missing category.
+func insertProduct(ctx context.Context, tx pgx.Tx, body createBody) (Product, error) {
+	categories, err := categoryNames(ctx, tx, []createBody{body})
+	if err != nil {
+		return Product{}, err
+	}
+	if body.CategoryID != nil && categories[*body.CategoryID] == "" {
+		return Product{}, errUnknownCategory
+	}
+	p := newProduct(body, categories)
+	if _, err := tx.Exec(ctx, insertProductSQL, insertArgs(p)...); err != nil {
+		return Product{}, err
+	}
+	if len(p.Tags) > 0 {
+		if err := setProductTags(ctx, tx, p.ID, p.Tags); err != nil {
+			return Product{}, err
+		}
+	}
+	if err := writeAudit(ctx, tx, p.ID, auditCreate, nil, &p); err != nil {
+		return Product{}, err
+	}
+	return p, nil
+}
+
+// createProduct serves POST /products. A dry run (?dryRun=true or
+// X-Dry-Run: true) does everything up to the commit, so uniqueness and the
+// category are checked too, then rolls back and answers 200 with the
+// product that would have been created.
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	dryRun, err := dryRunRequested(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	var body createBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Idempotency-Key too long")
+		return
+	}
+	if dryRun {
+		key = "" // nothing is stored, so there is nothing to replay
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	defer tx.Rollback(ctx) // no-op after Commit
+
+	if key != "" {
+		// the validated body is hashed, so retries that differ only in
+		// formatting or defaulted fields still count as the same request
+		canon, _ := json.Marshal(body)
+		hash := sha256.Sum256(canon)
+		stored, err := claimIdempotencyKey(ctx, tx, key, hash[:])
+		if errors.Is(err, errIdempotencyMismatch) {
+			writeError(w, http.StatusConflict, codeConflict, "Idempotency-Key was already used with a different request")
+			return
+		}
+		if err != nil {
+			writeDBError(w, err, "db error")
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(stored)
+			return
+		}
+	}
+
+	p, err := insertProduct(ctx, tx, body)
+	if err != nil {
+		if errors.Is(err, errUnknownCategory) {
+			writeFieldErrors(w, fieldErrors{"categoryId": "unknown category"})
+			return
+		}
+		if isUniqueViolation(err) {
+			writeError(w, http.StatusConflict, codeConflict, productConflict(err))
+			return
+		}
+		writeDBError(w, err, "insert error")
+		return
+	}
+	b, _ := json.Marshal(p)
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b) // the deferred Rollback discards the insert
+		return
+	}
+	if key != "" {
+		if err := storeIdempotentResponse(ctx, tx, key, b); err != nil {
+			writeDBError(w, err, "db error")
+			return
+		}
+	}
+	// the cache is only touched once the row is durable; a failed commit
+	// leaves both the table and the cache as they were
+	if err := tx.Commit(ctx); err != nil {
+		writeDBError(w, err, "commit error")
+		return
+	}
+
+	// invalidate cache
+	invalidateProduct(ctx, eventCreated, p)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(Product{
-		ID:         id,
-		Name:       body.Name,
-		PriceCents: body.PriceCents,
-		Stock:      body.Stock,
-		CreatedAt:  createdAt.Format(time.RFC3339),
-	})
+	w.Write(b)
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testPathParams fills openapi.json's path parameters with values the
+// handlers accept, so a request gets as far as the method check.
+var testPathParams = strings.NewReplacer(
+	"{id}", "00000000-0000-4000-8000-000000000000",
+	"{sku}", "SKU-1",
+)
+
+// TestSpecRoutes checks openapi.json against the registered routes: every
+// documented path is routed, and each one's handler serves exactly the
+// methods documented for it, answering 405 to the rest.
+func TestSpecRoutes(t *testing.T) {
+	// handlers that get past the method check hit the database; a pool
+	// that can't connect makes them fail fast instead of panicking on nil
+	pool, err := pgxpool.New(context.Background(), "postgres://test@127.0.0.1:1/test?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	db = pool
+
+	mux := newRoutes(newWSHandler(nil, 1, time.Minute), nil)
+	if err := checkSpecRoutes(mux); err != nil {
+		t.Fatal(err)
+	}
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	for path, ops := range spec.Paths {
+		target := testPathParams.Replace(path)
+		for _, method := range methodOrder {
+			if method == http.MethodOptions {
+				continue // answered by withCORS, not the handlers
+			}
+			_, documented := ops[strings.ToLower(method)]
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			r := httptest.NewRequestWithContext(ctx, method, target, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			cancel()
+			switch served := w.Code != http.StatusMethodNotAllowed; {
+			case documented && !served:
+				t.Errorf("%s %s is documented but answers 405", method, path)
+			case !documented && served:
+				t.Errorf("%s %s is not documented but answers %d", method, path, w.Code)
+			}
+		}
+	}
+}
+
+// TestWebhookReadsNeedKey checks that with API_KEYS set, webhook
+// subscriptions and dead letters can't be read without a key.
+func TestWebhookReadsNeedKey(t *testing.T) {
+	mux := newRoutes(newWSHandler(nil, 1, time.Minute), parseAPIKeys("secret"))
+	for _, path := range []string{"/webhooks", "/webhooks/dead-letters"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a key answers %d, want 401", path, w.Code)
+		}
+	}
+}
+
+// TestRouteMethods checks lookup prefers literal paths over templates.
+func TestRouteMethods(t *testing.T) {
+	rm, err := specRouteMethods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string][]string{
+		"/products/random":  {http.MethodGet, http.MethodOptions},
+		"/products/x":       {http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		"/products/x/stock": {http.MethodPatch, http.MethodOptions},
+		"/nope":             nil,
+	} {
+		if got := rm.lookup(path); !slices.Equal(got, want) {
+			t.Errorf("lookup(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+// TestClientIP checks X-Forwarded-For is believed only from trusted proxies,
+// and then only up to the first hop they didn't add.
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+	for _, tc := range []struct {
+		peer, xff, want string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"}, // untrusted peer
+		{"10.1.2.3:80", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:80", "6.6.6.6, 198.51.100.1", "198.51.100.1"}, // spoofed left entry
+		{"10.1.2.3:80", "198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		{"10.1.2.3:80", "10.9.9.9", "10.9.9.9"}, // only proxies
+		{"10.1.2.3:80", "", "10.1.2.3"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, XFF %q) = %s, want %s", tc.peer, tc.xff, got, tc.want)
+		}
+	}
+}
+
+// TestRequestTimeout checks a handler that hasn't answered by the deadline
+// gets a JSON 503, and that one already writing is streamed, not buffered
+// and replaced.
+func TestRequestTimeout(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 20 * time.Millisecond
+
+	slow := withRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Write([]byte("late"))
+	}))
+	w := httptest.NewRecorder()
+	slow.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), codeTimeout) || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("slow handler: %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	wrote := make(chan struct{})
+	streaming := withRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[1"))
+		close(wrote)
+		<-r.Context().Done()
+	}))
+	w = httptest.NewRecorder()
+	go func() {
+		<-wrote
+		if w.Body.String() != "[1" {
+			t.Errorf("first write was buffered, client has %q", w.Body.String())
+		}
+	}()
+	streaming.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "[1" {
+		t.Errorf("streaming handler: %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestDecimalPrices checks prices are read and written in each currency's
+// minor unit, with string arithmetic rather than floats.
+func TestDecimalPrices(t *testing.T) {
+	for _, tc := range []struct {
+		in, currency string
+		want         int
+		ok           bool
+	}{
+		{"12.99", "USD", 1299, true},
+		{"12.5", "USD", 1250, true},
+		{"12", "USD", 1200, true},
+		{"0.29", "USD", 29, true}, // 0.29*100 is 28.999... as a float
+		{"1299", "JPY", 1299, true},
+		{"12.99", "JPY", 0, false}, // no fractional yen
+		{"12.", "JPY", 0, false},
+		{"12.999", "USD", 0, false},
+		{"-1.00", "USD", 0, false},
+		{"+1.00", "USD", 0, false},
+		{"1e3", "USD", 0, false},
+		{".99", "USD", 0, false},
+		{"12.", "USD", 0, false},
+		{"", "USD", 0, false},
+		{"999999999999999", "USD", 99999999999999900, true}, // 15 digits
+		{"9999999999999999", "USD", 0, false},
+	} {
+		got, ok := parseDecimalPrice(tc.in, tc.currency)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseDecimalPrice(%q, %s) = %d, %v, want %d, %v", tc.in, tc.currency, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	for _, tc := range []struct {
+		amount             int
+		currency           string
+		decimal, formatted string
+	}{
+		{1299, "USD", "12.99", "$12.99"},
+		{5, "USD", "0.05", "$0.05"},
+		{0, "USD", "0.00", "$0.00"},
+		{123456789, "EUR", "1234567.89", "€1,234,567.89"},
+		{-1299, "USD", "-12.99", "-$12.99"},
+		{1299, "JPY", "1299", "¥1,299"},
+		{7, "JPY", "7", "¥7"},
+		{1299, "XYZ", "12.99", "XYZ 12.99"},
+	} {
+		if got := decimalPrice(tc.amount, tc.currency); got != tc.decimal {
+			t.Errorf("decimalPrice(%d, %s) = %q, want %q", tc.amount, tc.currency, got, tc.decimal)
+		}
+		if got := formatPrice(tc.amount, tc.currency); got != tc.formatted {
+			t.Errorf("formatPrice(%d, %s) = %q, want %q", tc.amount, tc.currency, got, tc.formatted)
+		}
+	}
+}
+
+// TestParseListParams checks the GET /products query string: defaults,
+// caps and the combinations it rejects.
+func TestParseListParams(t *testing.T) {
+	cursor := listCursor{CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC), ID: "00000000-0000-4000-8000-000000000000"}.encode()
+	for _, tc := range []struct {
+		query   string
+		wantErr string // substring; "" for success
+		check   func(listParams) bool
+	}{
+		{"", "", func(lp listParams) bool {
+			return lp.Limit == defaultListLimit && lp.Offset == 0 && lp.Sort == defaultSort && lp.isDefault()
+		}},
+		{"limit=10&offset=20", "", func(lp listParams) bool { return lp.Limit == 10 && lp.Offset == 20 && !lp.isDefault() }},
+		{"limit=100000", "", func(lp listParams) bool { return lp.Limit == maxListLimit }},
+		{"limit=0", "limit must be", nil},
+		{"limit=-1", "limit must be", nil},
+		{"limit=ten", "limit must be", nil},
+		{"offset=-1", "offset must be", nil},
+		{"cursor=" + cursor, "", func(lp listParams) bool {
+			return lp.Cursor != nil && lp.Cursor.ID == "00000000-0000-4000-8000-000000000000"
+		}},
+		{"cursor=" + cursor + "&offset=5", "cursor and offset cannot be combined", nil},
+		{"cursor=" + cursor + "&sort=price_asc", "cursor requires a created_* sort", nil},
+		{"cursor=garbage", "invalid cursor", nil},
+		{"minPrice=100&maxPrice=200", "", func(lp listParams) bool { return *lp.MinPrice == 100 && *lp.MaxPrice == 200 && lp.filtered() }},
+		{"minPrice=200&maxPrice=100", "minPrice must be <= maxPrice", nil},
+		{"minPrice=100&maxPrice=100", "", func(lp listParams) bool { return *lp.MinPrice == 100 }},
+		{"minPrice=-1", "minPrice must be", nil},
+		{"maxPrice=x", "maxPrice must be", nil},
+		{"inStock=true", "", func(lp listParams) bool { return lp.InStock && lp.filtered() }},
+		{"inStock=false", "", func(lp listParams) bool { return !lp.InStock && !lp.filtered() }},
+		{"inStock=yes", "inStock must be", nil},
+		{"inStock=true&outOfStock=true", "cannot be combined", nil},
+		{"sort=price_desc", "", func(lp listParams) bool { return lp.Sort == "price_desc" }},
+		{"sort=price_cents%3BDROP", "invalid sort", nil},
+		{"sort=relevance", "invalid sort", nil},
+		{"search=lamp", "", func(lp listParams) bool { return lp.Sort == relevanceSort }},
+		{"search=lamp&sort=name_asc", "", func(lp listParams) bool { return lp.Sort == "name_asc" }},
+		{"createdAfter=2026-01-01T00:00:00Z&createdBefore=2026-02-01T00:00:00Z", "", func(lp listParams) bool {
+			return lp.CreatedAfter.Month() == time.January && lp.CreatedBefore.Month() == time.February
+		}},
+		{"createdAfter=2026-02-01T00:00:00Z&createdBefore=2026-01-01T00:00:00Z", "createdAfter must be <= createdBefore", nil},
+		{"createdAfter=2026-01-01T01:00:00%2B01:00", "", func(lp listParams) bool { return lp.CreatedAfter.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) }},
+		{"createdAfter=yesterday", "createdAfter must be an RFC 3339 timestamp", nil},
+	} {
+		lp, err := parseListParams(httptest.NewRequest(http.MethodGet, "/products?"+tc.query, nil))
+		switch {
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%q: error %v, want %q", tc.query, err, tc.wantErr)
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", tc.query, err)
+		case tc.check != nil && err == nil && !tc.check(lp):
+			t.Errorf("%q: got %+v", tc.query, lp)
+		}
+	}
+}
+
+// TestWebhookRetryDelay checks the backoff doubles per attempt and stays
+// capped instead of overflowing for large base delays or attempt counts.
+func TestWebhookRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		base     time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 4, 8 * time.Second},
+		{time.Second, 13, maxWebhookDelay},
+		{time.Second, 1000, maxWebhookDelay},
+		{time.Minute, 31, maxWebhookDelay},
+		{24 * time.Hour, 1, maxWebhookDelay},
+		{1 << 40, 30, maxWebhookDelay},
+	} {
+		wk := &webhookWorker{baseDelay: tc.base}
+		if got := wk.retryDelay(tc.attempts); got != tc.want {
+			t.Errorf("retryDelay(%v, %d) = %v, want %v", tc.base, tc.attempts, got, tc.want)
+		}
+	}
+}
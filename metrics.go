@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	productsCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "products_cache_requests_total",
+		Help: "GET /products cache lookups by result (hit, miss, or bypass for lists other than the default first page).",
+	}, []string{"result"})
+
+	productsCachePopulateFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "products_cache_populate_failures_total",
+		Help: "Failed writes of a GET /products response to the cache.",
+	})
+
+	slowQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "db_slow_queries_total",
+		Help: "Queries that took longer than SLOW_QUERY_THRESHOLD.",
+	})
+)
+
+// registerPoolMetrics exposes pgxpool connection counts as gauges sampled on
+// every scrape.
+func registerPoolMetrics() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pgxpool_acquired_conns",
+		Help: "Connections currently checked out of the pool.",
+	}, func() float64 { return float64(db.Stat().AcquiredConns()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pgxpool_idle_conns",
+		Help: "Idle connections in the pool.",
+	}, func() float64 { return float64(db.Stat().IdleConns()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pgxpool_total_conns",
+		Help: "Total connections in the pool.",
+	}, func() float64 { return float64(db.Stat().TotalConns()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pgxpool_max_conns",
+		Help: "Most connections the pool will open (DB_MAX_CONNS).",
+	}, func() float64 { return float64(db.Stat().MaxConns()) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pgxpool_acquires_total",
+		Help: "Successful connection acquires from the pool.",
+	}, func() float64 { return float64(db.Stat().AcquireCount()) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pgxpool_empty_acquires_total",
+		Help: "Acquires that had to wait for a connection because none was idle.",
+	}, func() float64 { return float64(db.Stat().EmptyAcquireCount()) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pgxpool_acquire_duration_seconds_total",
+		Help: "Time spent acquiring connections from the pool.",
+	}, func() float64 { return db.Stat().AcquireDuration().Seconds() })
+}
+
+// poolStats is the GET /debug/pool response.
+type poolStats struct {
+	TotalConns          int32   `json:"totalConns"`
+	IdleConns           int32   `json:"idleConns"`
+	AcquiredConns       int32   `json:"acquiredConns"`
+	ConstructingConns   int32   `json:"constructingConns"`
+	MaxConns            int32   `json:"maxConns"`
+	AcquireCount        int64   `json:"acquireCount"`
+	EmptyAcquireCount   int64   `json:"emptyAcquireCount"`
+	CanceledAcquires    int64   `json:"canceledAcquireCount"`
+	AcquireDurationSecs float64 `json:"acquireDurationSeconds"` // total, across all acquires
+}
+
+// handlePoolStats serves GET /debug/pool: db.Stat() read fresh on each
+// request. Acquired connections stuck near maxConns while idle stays at 0
+// means the pool is saturated, or connections aren't being released.
+func handlePoolStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	s := db.Stat()
+	writeJSON(w, http.StatusOK, poolStats{
+		TotalConns:          s.TotalConns(),
+		IdleConns:           s.IdleConns(),
+		AcquiredConns:       s.AcquiredConns(),
+		ConstructingConns:   s.ConstructingConns(),
+		MaxConns:            s.MaxConns(),
+		AcquireCount:        s.AcquireCount(),
+		EmptyAcquireCount:   s.EmptyAcquireCount(),
+		CanceledAcquires:    s.CanceledAcquireCount(),
+		AcquireDurationSecs: s.AcquireDuration().Seconds(),
+	})
+}
+
+// withMetrics records request count and latency. The route label is the
+// matched mux pattern (e.g. "/products/"), never the raw path, so ids don't
+// blow up label cardinality.
+func withMetrics(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		route := "other"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		code := strconv.Itoa(sr.code())
+		httpRequests.WithLabelValues(route, code).Inc()
+		httpDuration.WithLabelValues(route, code).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusRecorder captures the status code written by a handler. A handler
+// that never calls WriteHeader got an implicit 200.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) code() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// withLogging writes one access log record per request.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.code(),
+			"bytes", sr.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// withRecover turns a handler panic into a logged 500, so one bad request
+// doesn't take the process and every other in-flight request down with it.
+// If the response had already started it can't be replaced, so the
+// connection is aborted instead. http.ErrAbortHandler passes through.
+func withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", v,
+				"stack", string(debug.Stack()),
+			)
+			if sr.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		}()
+		next.ServeHTTP(sr, r)
+	})
+}
+
+// requestTimeout is how long a handler has to answer (HTTP_REQUEST_TIMEOUT);
+// 0 disables the deadline.
+var requestTimeout = 30 * time.Second
+
+// withRequestTimeout gives each request requestTimeout to be answered. The
+// handler's context is cancelled at the deadline, taking any query it is
+// running with it, and a client that has had no response yet gets a 503.
+// Unlike http.TimeoutHandler nothing is buffered, so a list page can stream;
+// once a response has started it can only be cut short by the cancelled
+// context. Routes that run as long as the client wants are left out.
+func withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 || longLived(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		tw := &timeoutWriter{w: w, h: make(http.Header)}
+		// the writer is expired before the context is cancelled, so a
+		// handler reacting to the cancellation can't answer over the 503
+		expired := make(chan struct{})
+		timer := time.AfterFunc(requestTimeout, func() {
+			if tw.expire() {
+				close(expired)
+			}
+			cancel()
+		})
+		defer timer.Stop()
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					panicked <- v
+					return
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+		// once the response has started, the handler owns w until it
+		// returns, which the cancelled context hurries along
+		select {
+		case v := <-panicked:
+			panic(v) // for withRecover, on this goroutine
+		case <-done:
+			select {
+			case <-expired:
+			default:
+				return
+			}
+		case <-expired:
+			// the handler may still be running, but can no longer write
+		}
+		writeError(w, http.StatusServiceUnavailable, codeTimeout, "request timed out")
+	})
+}
+
+// longLived reports whether r is for a route that streams: SSE, WebSocket,
+// the CSV import and exports, the NDJSON list and pprof's timed profiles.
+func longLived(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/products/events", "/ws", "/products/import", "/products.csv":
+		return true
+	case "/products":
+		return (r.Method == http.MethodGet || r.Method == http.MethodHead) && wantsNDJSON(r)
+	}
+	return strings.HasPrefix(r.URL.Path, "/debug/pprof/")
+}
+
+// timeoutWriter is the ResponseWriter withRequestTimeout hands its handler.
+// Headers collect in h until the response starts; after expire, every write
+// fails with http.ErrHandlerTimeout, so the handler can outlive the request
+// without touching w.
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	h        http.Header
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && !tw.started {
+		tw.writeHeader(code)
+	}
+}
+
+// writeHeader sends h and the status; tw.mu must be held.
+func (tw *timeoutWriter) writeHeader(code int) {
+	maps.Copy(tw.w.Header(), tw.h)
+	tw.w.WriteHeader(code)
+	// 1xx responses don't end the header phase
+	tw.started = code >= 200
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.started {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+// Flush lets streaming handlers, and withGzip over them, push data out.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.started {
+		tw.writeHeader(http.StatusOK)
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+// expire reports whether the deadline beat the response, in which case the
+// caller writes the 503 and the handler's writes are refused from now on.
+func (tw *timeoutWriter) expire() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.started {
+		return false
+	}
+	tw.timedOut = true
+	return true
+}
+
+// withBodyLimit caps every request body at maxBodyBytes, or importMaxBytes
+// for CSV imports. A declared Content-Length over the cap is refused with
+// 413 before the handler runs; otherwise reading past it fails with an
+// *http.MaxBytesError, which decodeBody and the importer turn into 413.
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBodyBytes
+		if r.URL.Path == "/products/import" {
+			limit = importMaxBytes
+		}
+		if r.ContentLength > limit {
+			writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipMinSize is the smallest body worth compressing.
+const gzipMinSize = 1024
+
+var gzipPool = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// gzipResponseWriter buffers the first gzipMinSize bytes before deciding
+// whether to compress, so small bodies go out as-is. For HEAD it makes the
+// same decision, so the headers match GET's; a compressed HEAD body is only
+// counted, and the headers wait for close so they can carry its length.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head    bool
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+	headLen byteCounter // compressed HEAD body size
+}
+
+// byteCounter is an io.Writer that only counts.
+type byteCounter int
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+	// 1xx responses are sent immediately and don't end the header phase
+	if code < 200 {
+		g.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if !g.decided {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// decide sends the headers and buffered bytes, compressed if big is set and
+// the response is eligible.
+func (g *gzipResponseWriter) decide(big bool) error {
+	g.decided = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	h := g.Header()
+	if big && compressible(g.status, h) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		g.gz = gzipPool.Get().(*gzip.Writer)
+		if g.head {
+			g.gz.Reset(&g.headLen) // close sends the headers
+		} else {
+			g.gz.Reset(g.ResponseWriter)
+			g.ResponseWriter.WriteHeader(g.status)
+		}
+		_, err := g.gz.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// compressible rejects bodyless statuses, responses that already carry an
+// encoding and content that is already compressed or streamed.
+func compressible(status int, h http.Header) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < 200 {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	for _, prefix := range []string{"image/", "video/", "audio/", "text/event-stream", "application/zip", "application/gzip", "application/octet-stream"} {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush forces the compression decision so streaming handlers work.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.decide(true)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+		if g.head {
+			return // flushing would send the headers before the length is known
+		}
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) close() {
+	if !g.decided {
+		if g.status == 0 {
+			// handler wrote nothing at all; let net/http send its default 200
+			return
+		}
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+		g.gz = nil
+		if g.head {
+			g.Header().Set("Content-Length", strconv.Itoa(int(g.headLen)))
+			g.ResponseWriter.WriteHeader(g.status)
+		}
+	}
+}
+
+// withGzip compresses responses for clients that accept gzip.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// upgraded connections are hijacked and never write a body through us
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		// honour an explicit "gzip;q=0"
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+	return false
+}
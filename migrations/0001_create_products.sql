@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS products(
+  id uuid PRIMARY KEY,
+  name text NOT NULL,
+  price_cents int NOT NULL,
+  stock int NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
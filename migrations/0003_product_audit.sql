@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS product_audit(
+  id bigserial PRIMARY KEY,
+  product_id uuid NOT NULL,
+  action text NOT NULL,
+  old_value jsonb,
+  new_value jsonb,
+  at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS product_audit_product_at_idx ON product_audit (product_id, at DESC);
@@ -0,0 +1,2 @@
+-- existing rows were priced in dollars
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency text NOT NULL DEFAULT 'USD';
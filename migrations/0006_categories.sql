@@ -0,0 +1,9 @@
+CREATE TABLE categories(
+  id uuid PRIMARY KEY,
+  name text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX categories_name_lower_key ON categories (lower(name));
+
+ALTER TABLE products ADD COLUMN category_id uuid REFERENCES categories(id);
+CREATE INDEX products_category_id_idx ON products (category_id);
@@ -0,0 +1,11 @@
+CREATE TABLE tags(
+  id bigserial PRIMARY KEY,
+  name text NOT NULL UNIQUE -- normalized: trimmed, lower case
+);
+
+CREATE TABLE product_tags(
+  product_id uuid NOT NULL REFERENCES products(id),
+  tag_id bigint NOT NULL REFERENCES tags(id),
+  PRIMARY KEY (product_id, tag_id)
+);
+CREATE INDEX product_tags_tag_id_idx ON product_tags (tag_id);
@@ -0,0 +1,3 @@
+ALTER TABLE products ADD COLUMN search_vector tsvector
+  GENERATED ALWAYS AS (to_tsvector('english', name)) STORED;
+CREATE INDEX products_search_vector_idx ON products USING GIN (search_vector);
@@ -0,0 +1,10 @@
+ALTER TABLE products ADD COLUMN description text;
+
+-- generated columns can't change their expression in place
+ALTER TABLE products DROP COLUMN search_vector;
+ALTER TABLE products ADD COLUMN search_vector tsvector
+  GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', name), 'A') ||
+    setweight(to_tsvector('english', coalesce(description, '')), 'B')
+  ) STORED;
+CREATE INDEX products_search_vector_idx ON products USING GIN (search_vector);
@@ -0,0 +1,4 @@
+ALTER TABLE products ADD COLUMN sku text;
+-- like names, SKUs are only unique among live products so a deleted
+-- product's SKU can be reused
+CREATE UNIQUE INDEX products_sku_live_key ON products (sku) WHERE deleted_at IS NULL;
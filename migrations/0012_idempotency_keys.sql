@@ -0,0 +1,7 @@
+CREATE TABLE idempotency_keys(
+  key text PRIMARY KEY,
+  request_hash bytea NOT NULL,
+  response jsonb, -- set once the create it guards has succeeded
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
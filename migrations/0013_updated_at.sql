@@ -0,0 +1,5 @@
+ALTER TABLE products ADD COLUMN updated_at timestamptz;
+UPDATE products SET updated_at = created_at;
+ALTER TABLE products
+  ALTER COLUMN updated_at SET DEFAULT now(),
+  ALTER COLUMN updated_at SET NOT NULL;
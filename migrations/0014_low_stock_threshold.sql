@@ -0,0 +1 @@
+ALTER TABLE products ADD COLUMN low_stock_threshold integer CHECK (low_stock_threshold >= 0);
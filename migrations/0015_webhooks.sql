@@ -0,0 +1,41 @@
+CREATE TABLE webhook_subscriptions(
+  id uuid PRIMARY KEY,
+  url text NOT NULL,
+  secret text NOT NULL,
+  events text[] NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- one row per (subscription, audited change) still to be delivered; rows are
+-- deleted once delivered and kept with dead_at set once retries run out
+CREATE TABLE webhook_deliveries(
+  id bigserial PRIMARY KEY,
+  subscription_id uuid NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+  audit_id bigint NOT NULL REFERENCES product_audit(id),
+  event text NOT NULL,
+  attempts int NOT NULL DEFAULT 0,
+  next_attempt_at timestamptz NOT NULL DEFAULT now(),
+  last_error text,
+  dead_at timestamptz,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE dead_at IS NULL;
+
+-- every product change is audited, so queueing deliveries off the audit
+-- insert covers all write paths (single, batch and COPY) transactionally
+CREATE FUNCTION queue_product_webhooks() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+  ev text := CASE NEW.action
+    WHEN 'create' THEN 'product.created'
+    WHEN 'delete' THEN 'product.deleted'
+    ELSE 'product.updated'
+  END;
+BEGIN
+  INSERT INTO webhook_deliveries(subscription_id, audit_id, event)
+  SELECT id, NEW.id, ev FROM webhook_subscriptions WHERE ev = ANY(events);
+  RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER product_audit_webhooks AFTER INSERT ON product_audit
+  FOR EACH ROW EXECUTE FUNCTION queue_product_webhooks();
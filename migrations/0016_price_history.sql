@@ -0,0 +1,28 @@
+CREATE TABLE price_history(
+  id bigserial PRIMARY KEY,
+  product_id uuid NOT NULL REFERENCES products(id),
+  price_cents int NOT NULL,
+  currency text NOT NULL,
+  changed_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX price_history_product_changed_idx ON price_history (product_id, changed_at);
+
+-- earlier changes weren't kept; start every timeline at the current price
+INSERT INTO price_history(product_id, price_cents, currency, changed_at)
+SELECT id, price_cents, currency, created_at FROM products;
+
+-- a trigger records the price in the writing transaction on every path
+-- (single, batch and COPY inserts as well as PUT and PATCH)
+CREATE FUNCTION record_price_history() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+  IF TG_OP = 'INSERT'
+     OR NEW.price_cents IS DISTINCT FROM OLD.price_cents
+     OR NEW.currency IS DISTINCT FROM OLD.currency THEN
+    INSERT INTO price_history(product_id, price_cents, currency) VALUES (NEW.id, NEW.price_cents, NEW.currency);
+  END IF;
+  RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER products_price_history AFTER INSERT OR UPDATE OF price_cents, currency ON products
+  FOR EACH ROW EXECUTE FUNCTION record_price_history();
@@ -0,0 +1,6 @@
+ALTER TABLE products
+  ADD COLUMN sale_price_cents int,
+  ADD COLUMN sale_starts_at timestamptz,
+  ADD COLUMN sale_ends_at timestamptz,
+  ADD CONSTRAINT products_sale_price_check CHECK (sale_price_cents > 0 AND sale_price_cents < price_cents),
+  ADD CONSTRAINT products_sale_range_check CHECK (sale_starts_at < sale_ends_at);
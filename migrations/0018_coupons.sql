@@ -0,0 +1,11 @@
+CREATE TABLE coupons(
+  code text PRIMARY KEY,
+  percent_off int CHECK (percent_off BETWEEN 1 AND 100),
+  amount_off_cents int CHECK (amount_off_cents > 0),
+  expires_at timestamptz,
+  max_uses int CHECK (max_uses > 0),
+  used_count int NOT NULL DEFAULT 0,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  CHECK ((percent_off IS NULL) <> (amount_off_cents IS NULL)),
+  CHECK (max_uses IS NULL OR used_count <= max_uses)
+);
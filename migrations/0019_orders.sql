@@ -0,0 +1,19 @@
+CREATE TABLE orders(
+  id uuid PRIMARY KEY,
+  total_cents bigint NOT NULL,
+  currency text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- lines keep the name and unit price charged, so later product edits don't
+-- rewrite past orders
+CREATE TABLE order_items(
+  order_id uuid NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  product_id uuid NOT NULL REFERENCES products(id),
+  name text NOT NULL,
+  quantity int NOT NULL CHECK (quantity > 0),
+  unit_price_cents int NOT NULL,
+  line_total_cents bigint NOT NULL,
+  PRIMARY KEY (order_id, product_id)
+);
+CREATE INDEX order_items_product_idx ON order_items (product_id);
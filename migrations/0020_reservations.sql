@@ -0,0 +1,11 @@
+-- units held for a checkout; a row counts against available stock until
+-- expires_at, after which the sweeper may delete it
+CREATE TABLE reservations(
+  id uuid PRIMARY KEY,
+  product_id uuid NOT NULL REFERENCES products(id),
+  quantity int NOT NULL CHECK (quantity > 0),
+  expires_at timestamptz NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX reservations_product_expires_idx ON reservations (product_id, expires_at);
+CREATE INDEX reservations_expires_idx ON reservations (expires_at);
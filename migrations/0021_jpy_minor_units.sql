@@ -0,0 +1,34 @@
+-- JPY has no minor unit: its *_cents columns now count whole yen, where
+-- they used to count hundredths like every other currency. Rescale the
+-- amounts stored before, rounding to the nearest yen (and at least 1 where
+-- the column must be positive). Audit snapshots and webhook payloads keep
+-- the values they were recorded with; coupons' amount_off_cents has no
+-- currency and is left as it is.
+
+-- a sale that rounds to the price or below 1 yen no longer discounts
+UPDATE products SET sale_price_cents = NULL, sale_starts_at = NULL, sale_ends_at = NULL
+WHERE currency = 'JPY' AND sale_price_cents IS NOT NULL
+  AND (round(sale_price_cents / 100.0) < 1 OR round(sale_price_cents / 100.0) >= GREATEST(1, round(price_cents / 100.0)));
+
+-- the rescaled price is the same price, so it isn't recorded as a change
+ALTER TABLE products DISABLE TRIGGER products_price_history;
+UPDATE products SET
+  price_cents = GREATEST(1, round(price_cents / 100.0))::int,
+  sale_price_cents = round(sale_price_cents / 100.0)::int,
+  version = version + 1,
+  updated_at = now()
+WHERE currency = 'JPY';
+ALTER TABLE products ENABLE TRIGGER products_price_history;
+
+UPDATE price_history SET price_cents = GREATEST(1, round(price_cents / 100.0))::int
+WHERE currency = 'JPY';
+
+UPDATE order_items i SET
+  unit_price_cents = round(i.unit_price_cents / 100.0)::int,
+  line_total_cents = round(i.unit_price_cents / 100.0)::bigint * i.quantity
+FROM orders o
+WHERE o.id = i.order_id AND o.currency = 'JPY';
+
+-- totals are re-added from the rescaled lines so they still agree
+UPDATE orders o SET total_cents = (SELECT COALESCE(sum(line_total_cents), 0) FROM order_items WHERE order_id = o.id)
+WHERE o.currency = 'JPY';
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// currencyInfo describes how amounts in a currency are written.
+type currencyInfo struct {
+	symbol string // prefix of formatted prices
+	// minorUnits is the number of decimal places: priceCents and every
+	// other *Cents amount count in 10^-minorUnits of the currency, so 1299
+	// is $12.99 but ¥1299.
+	minorUnits int
+}
+
+// currencies whitelists the ISO 4217 codes products may be priced in.
+var currencies = map[string]currencyInfo{
+	"USD": {"$", 2}, "EUR": {"€", 2}, "GBP": {"£", 2}, "CAD": {"CA$", 2}, "AUD": {"A$", 2},
+	"JPY": {"¥", 0}, "CHF": {"CHF ", 2}, "MXN": {"MX$", 2}, "BRL": {"R$", 2}, "INR": {"₹", 2},
+}
+
+// defaultCurrency is used when a create or update omits currency
+// (DEFAULT_CURRENCY).
+var defaultCurrency = "USD"
+
+// minorUnits returns currency's decimal places, 2 for unknown codes.
+func minorUnits(currency string) int {
+	if c, ok := currencies[currency]; ok {
+		return c.minorUnits
+	}
+	return 2
+}
+
+// decimalPrice writes an amount in currency's minor unit as a decimal, e.g.
+// 1299 as "12.99" in USD and "1299" in JPY. It works on the integer, so
+// there is no float rounding.
+func decimalPrice(amount int, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	places := minorUnits(currency)
+	if places == 0 {
+		return sign + strconv.Itoa(amount)
+	}
+	s := strconv.Itoa(amount)
+	if len(s) <= places {
+		s = strings.Repeat("0", places-len(s)+1) + s
+	}
+	return sign + s[:len(s)-places] + "." + s[len(s)-places:]
+}
+
+// formatPrice writes an amount for display in currency, e.g. "$1,299.00" or
+// "¥1,299". Codes without a symbol are written with their code and a space.
+func formatPrice(amount int, currency string) string {
+	sym := currency + " "
+	if c, ok := currencies[currency]; ok {
+		sym = c.symbol
+	}
+	s := decimalPrice(amount, currency)
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, dot := strings.Cut(s, ".")
+	var b strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	if dot {
+		b.WriteString("." + frac)
+	}
+	return sign + sym + b.String()
+}
+
+// setDisplayPrice fills in the Price and PriceFormatted renderings of
+// PriceCents.
+func (p *Product) setDisplayPrice() {
+	p.Price = decimalPrice(p.PriceCents, p.Currency)
+	p.PriceFormatted = formatPrice(p.PriceCents, p.Currency)
+}
+
+// decimalPriceInvalid is the price error for currency.
+func decimalPriceInvalid(currency string) string {
+	if minorUnits(currency) == 0 {
+		return "must be a whole amount in " + currency + `, e.g. "1299"`
+	}
+	return "must be a decimal amount with at most " + strconv.Itoa(minorUnits(currency)) + ` places, e.g. "12.99"`
+}
+
+// parseDecimalPrice reads a decimal amount such as "12.99", "12.5" or "12"
+// in currency's minor unit: 1299 cents in USD, while JPY, having none,
+// only takes whole amounts. It is string arithmetic, so "0.29" is exactly
+// 29 rather than whatever a float rounds to. Signs, exponents and more
+// places than the currency has are rejected.
+func parseDecimalPrice(s, currency string) (int, bool) {
+	places := minorUnits(currency)
+	whole, frac, dot := strings.Cut(s, ".")
+	if whole == "" || len(whole) > 15 || len(frac) > places || (dot && frac == "") {
+		return 0, false
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, false
+			}
+		}
+	}
+	n, _ := strconv.Atoi(whole + frac + strings.Repeat("0", places-len(frac)))
+	return n, true
+}
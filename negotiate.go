@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// representations GET /products and /products/:id can be served in, in
+// order of preference when the client likes them equally
+const (
+	contentJSON = "application/json"
+	contentXML  = "application/xml"
+)
+
+// contentNDJSON is the newline-delimited JSON export of GET /products.
+const contentNDJSON = "application/x-ndjson"
+
+// wantsNDJSON reports whether a GET /products asks for the NDJSON stream,
+// with ?format=ndjson or by naming it in Accept with a non-zero q.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != contentNDJSON {
+			continue
+		}
+		q, err := strconv.ParseFloat(cmp.Or(params["q"], "1"), 64)
+		return err == nil && q > 0
+	}
+	return false
+}
+
+// negotiate picks the representation for r's Accept header: JSON when it is
+// absent, otherwise the supported type with the highest q (text/xml counts
+// as XML). If none is acceptable it writes 406 and returns ok=false.
+func negotiate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return contentJSON, true
+	}
+	qJSON, qXML := -1.0, -1.0
+	specJSON, specXML := -1, -1 // how specific the range that set q was
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, t := range []struct {
+			types []string
+			q     *float64
+			spec  *int
+		}{
+			{[]string{contentJSON}, &qJSON, &specJSON},
+			{[]string{contentXML, "text/xml"}, &qXML, &specXML},
+		} {
+			if s := rangeMatch(mt, t.types); s > *t.spec {
+				*t.q, *t.spec = q, s
+			}
+		}
+	}
+	switch {
+	case qJSON > 0 && qJSON >= qXML:
+		return contentJSON, true
+	case qXML > 0:
+		return contentXML, true
+	}
+	writeError(w, http.StatusNotAcceptable, codeNotAcceptable, "supported types are "+contentJSON+" and "+contentXML)
+	return "", false
+}
+
+// rangeMatch reports how specifically the media range mt covers any of
+// types: 2 for an exact match, 1 for type/*, 0 for */* and -1 for none.
+// The most specific range decides a type's q, as RFC 9110 says.
+func rangeMatch(mt string, types []string) int {
+	best := -1
+	for _, t := range types {
+		major, _, _ := strings.Cut(t, "/")
+		switch mt {
+		case t:
+			return 2
+		case major + "/*":
+			best = max(best, 1)
+		case "*/*":
+			best = max(best, 0)
+		}
+	}
+	return best
+}
+
+// writeXML writes v as an XML document with the given status.
+func writeXML(w http.ResponseWriter, status int, v any) {
+	b, err := marshalXML(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "encode error")
+		return
+	}
+	w.Header().Set("Content-Type", contentXML+"; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// marshalXML encodes v as a complete XML document.
+func marshalXML(v any) ([]byte, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
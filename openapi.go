@@ -0,0 +1,178 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// openAPISpec is the handwritten API description served at /openapi.json.
+// checkSpecRoutes keeps its paths in step with the mux.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// routeMux is an http.ServeMux that remembers its patterns, so they can be
+// checked against the spec.
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux()}
+}
+
+func (m *routeMux) Handle(pattern string, h http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, h)
+}
+
+func (m *routeMux) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(h))
+}
+
+// specParam matches a path template parameter such as {id}.
+var specParam = regexp.MustCompile(`\{[^}/]+\}`)
+
+// checkSpecRoutes reports documented paths the mux doesn't route and mux
+// patterns no documented path reaches. main refuses to start on either, so
+// a route can't be added or dropped without updating openapi.json;
+// TestSpecRoutes also checks each route's methods.
+func checkSpecRoutes(mux *routeMux) error {
+	var spec struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return err
+	}
+	var errs []error
+	reached := map[string]bool{}
+	for path := range spec.Paths {
+		r := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: specParam.ReplaceAllString(path, "x")}}
+		_, pattern := mux.Handler(r)
+		if !slices.Contains(mux.patterns, pattern) {
+			errs = append(errs, errors.New("documented path "+path+" is not routed"))
+			continue
+		}
+		reached[pattern] = true
+	}
+	for _, p := range mux.patterns {
+		if !reached[p] {
+			errs = append(errs, errors.New("route "+p+" is not documented"))
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// routeMethods maps the documented paths to the methods they serve, as
+// listed in openapi.json, plus OPTIONS, which withCORS answers everywhere.
+// The spec is checked against the mux and is the one place methods are
+// listed per path, so Allow headers follow it.
+type routeMethods struct {
+	exact     map[string][]string
+	templates []routeTemplate // fewest parameters first
+}
+
+type routeTemplate struct {
+	re      *regexp.Regexp
+	params  int
+	methods []string
+}
+
+// methodOrder is the order methods are listed in Allow headers.
+var methodOrder = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// specRouteMethods reads routeMethods from openAPISpec.
+func specRouteMethods() (*routeMethods, error) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, err
+	}
+	rm := &routeMethods{exact: map[string][]string{}}
+	for path, ops := range spec.Paths {
+		var methods []string
+		for _, m := range methodOrder {
+			if _, ok := ops[strings.ToLower(m)]; ok || m == http.MethodOptions {
+				methods = append(methods, m)
+			}
+		}
+		if !specParam.MatchString(path) {
+			rm.exact[path] = methods
+			continue
+		}
+		literals := specParam.Split(path, -1)
+		for i, l := range literals {
+			literals[i] = regexp.QuoteMeta(l)
+		}
+		rm.templates = append(rm.templates, routeTemplate{
+			re:      regexp.MustCompile("^" + strings.Join(literals, "[^/]+") + "$"),
+			params:  len(literals) - 1,
+			methods: methods,
+		})
+	}
+	slices.SortFunc(rm.templates, func(a, b routeTemplate) int { return a.params - b.params })
+	return rm, nil
+}
+
+// lookup returns the methods path serves, or nil if no documented path
+// matches it. A literal path such as /products/random wins over a template
+// such as /products/{id}. rm may be nil.
+func (rm *routeMethods) lookup(path string) []string {
+	if rm == nil {
+		return nil
+	}
+	if m, ok := rm.exact[path]; ok {
+		return m
+	}
+	for _, t := range rm.templates {
+		if t.re.MatchString(path) {
+			return t.methods
+		}
+	}
+	return nil
+}
+
+// serveOpenAPI serves GET /openapi.json.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// docsPage renders /openapi.json with Swagger UI from a CDN.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>store-svc API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// serveDocs serves GET /docs.
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
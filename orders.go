@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxOrderItems caps the lines of one order.
+const maxOrderItems = 100
+
+// Order is a recorded sale. Every line is in Currency; TotalCents is the sum
+// of the line totals.
+type Order struct {
+	ID         string      `json:"id"`
+	Items      []orderItem `json:"items"`
+	TotalCents int         `json:"totalCents"`
+	Currency   string      `json:"currency"`
+	CreatedAt  string      `json:"created_at"`
+}
+
+// orderItem is an order line at the effective price when it was placed.
+type orderItem struct {
+	ProductID      string `json:"productId"`
+	Name           string `json:"name"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int    `json:"unitPriceCents"`
+	LineTotalCents int    `json:"lineTotalCents"`
+}
+
+type orderBody struct {
+	Items []cartItemBody `json:"items"`
+}
+
+func (b *orderBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	if len(b.Items) == 0 || len(b.Items) > maxOrderItems {
+		errs["items"] = "must have 1 to " + strconv.Itoa(maxOrderItems) + " lines"
+		return errs
+	}
+	seen := map[string]bool{}
+	for i := range b.Items {
+		prefix := "items[" + strconv.Itoa(i) + "]."
+		for f, msg := range b.Items[i].validate() {
+			errs[prefix+f] = msg
+		}
+		if id := b.Items[i].ProductID; seen[id] {
+			errs[prefix+"productId"] = "repeats an earlier line"
+		} else {
+			seen[id] = true
+		}
+	}
+	return errs
+}
+
+// orderLineError rolls back a checkout because of one line's product. With
+// field set it is a 400 validation error on that field instead.
+type orderLineError struct {
+	status    int
+	code      string
+	msg       string
+	productID string
+	field     string
+}
+
+func (e *orderLineError) Error() string { return e.msg + ": " + e.productID }
+
+// ordersHandler serves POST /orders.
+func ordersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body orderBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	o, old, updated, err := placeOrder(r.Context(), body.Items)
+	var lineErr *orderLineError
+	if errors.As(err, &lineErr) && lineErr.field != "" {
+		writeFieldErrors(w, fieldErrors{lineErr.field: lineErr.msg})
+		return
+	}
+	if errors.As(err, &lineErr) {
+		writeAPIError(w, lineErr.status, apiError{Code: lineErr.code, Message: lineErr.msg, ProductID: lineErr.productID})
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	for i := range updated {
+		checkLowStock(old[i], updated[i])
+	}
+	invalidateProduct(r.Context(), eventUpdated, updated...)
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// placeOrder checks the available stock of every line and takes it, then
+// records the order, all in one transaction; the first line that can't be
+// filled rolls everything back with an *orderLineError. Products are locked
+// in id order so concurrent checkouts over the same products can't
+// deadlock. It returns
+// the products before and after, in matching order, for the caller's
+// notifications.
+func placeOrder(ctx context.Context, lines []cartItemBody) (o Order, old, updated []Product, err error) {
+	ids := make([]string, len(lines))
+	for i, l := range lines {
+		ids[i] = l.ProductID
+	}
+	o = Order{ID: uuid.NewString(), Items: make([]orderItem, 0, len(lines))}
+
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			`SELECT `+productColumns+` FROM products`+productJoins+`
+			 WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL ORDER BY id FOR UPDATE OF products`, ids,
+		)
+		if err != nil {
+			return err
+		}
+		locked, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Product, error) { return scanProduct(row) })
+		if err != nil {
+			return err
+		}
+
+		old, updated = old[:0], updated[:0]
+		for k, l := range lines {
+			i := slices.IndexFunc(locked, func(p Product) bool { return p.ID == l.ProductID })
+			if i < 0 {
+				return &orderLineError{http.StatusNotFound, codeNotFound, "product not found", l.ProductID, ""}
+			}
+			p := locked[i]
+			if p.AvailableStock < l.Quantity {
+				return &orderLineError{http.StatusConflict, codeInsufficientStock, "insufficient stock", l.ProductID, ""}
+			}
+			if o.Currency == "" {
+				o.Currency = p.Currency
+			} else if p.Currency != o.Currency {
+				return &orderLineError{http.StatusConflict, codeConflict, "products in an order must share a currency", l.ProductID, ""}
+			}
+			total, ok := lineTotal(p.EffectivePriceCents, l.Quantity)
+			if !ok || o.TotalCents > math.MaxInt-total {
+				field := "items[" + strconv.Itoa(k) + "].quantity"
+				return &orderLineError{http.StatusBadRequest, codeValidation, "makes the order total too large", l.ProductID, field}
+			}
+			line := orderItem{
+				ProductID:      p.ID,
+				Name:           p.Name,
+				Quantity:       l.Quantity,
+				UnitPriceCents: p.EffectivePriceCents,
+				LineTotalCents: total,
+			}
+			o.Items = append(o.Items, line)
+			o.TotalCents += total
+
+			// see updateWithAuditTx for why the CTE is named products
+			n, err := scanProduct(tx.QueryRow(ctx,
+				`WITH products AS (UPDATE products SET stock = stock - $2, version = version + 1, updated_at = now()
+				 WHERE id = $1::uuid RETURNING *) SELECT `+productColumns+` FROM products`+productJoins,
+				p.ID, l.Quantity,
+			))
+			if err != nil {
+				return err
+			}
+			if err := writeAudit(ctx, tx, p.ID, auditPurchase, &p, &n); err != nil {
+				return err
+			}
+			old, updated = append(old, p), append(updated, n)
+		}
+
+		var created time.Time
+		if err := tx.QueryRow(ctx,
+			`INSERT INTO orders(id, total_cents, currency) VALUES($1, $2, $3) RETURNING created_at`,
+			o.ID, o.TotalCents, o.Currency,
+		).Scan(&created); err != nil {
+			return err
+		}
+		o.CreatedAt = created.Format(time.RFC3339)
+		for _, l := range o.Items {
+			if _, err := tx.Exec(ctx,
+				`INSERT INTO order_items(order_id, product_id, name, quantity, unit_price_cents, line_total_cents)
+				 VALUES($1, $2, $3, $4, $5, $6)`,
+				o.ID, l.ProductID, l.Name, l.Quantity, l.UnitPriceCents, l.LineTotalCents,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return o, old, updated, err
+}
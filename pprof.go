@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the runtime profiles under /debug/pprof/: the index,
+// named profiles such as /debug/pprof/heap and /debug/pprof/goroutine, and
+// CPU profiles and traces (?seconds=N).
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
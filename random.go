@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultRandomCount and maxRandomCount bound GET /products/random's count.
+const (
+	defaultRandomCount = 3
+	maxRandomCount     = 20
+)
+
+// getRandomProducts serves GET /products/random?count=n: up to n products
+// with available stock, in random order. ORDER BY random() reads every live
+// row, which is fine at catalogue sizes; a far larger table would want
+// TABLESAMPLE instead. Responses are never cached, since the point is
+// variety.
+func getRandomProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	count := defaultRandomCount
+	if s := r.URL.Query().Get("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxRandomCount {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "count must be between 1 and "+strconv.Itoa(maxRandomCount))
+			return
+		}
+		count = n
+	}
+
+	rows, err := db.Query(r.Context(),
+		`SELECT `+productColumns+` FROM products`+productJoins+`
+		 WHERE deleted_at IS NULL AND `+availableStockExpr+` > 0 ORDER BY random() LIMIT $1`, count,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Product, error) { return scanProduct(row) })
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if items == nil {
+		items = []Product{}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, items)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter decides whether a client may make another request; when it
+// may not, retryAfter says when to try again.
+type rateLimiter interface {
+	allow(ctx context.Context, ip string) (ok bool, retryAfter time.Duration)
+}
+
+// ipLimiter hands out one token bucket per client IP and evicts buckets that
+// have been idle for longer than ttl so the map stays bounded.
+type ipLimiter struct {
+	mu      sync.Mutex
+	rps     rate.Limit
+	burst   int
+	ttl     time.Duration
+	clients map[string]*ipClient
+}
+
+type ipClient struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiter(rps float64, burst int, ttl time.Duration) *ipLimiter {
+	l := &ipLimiter{rps: rate.Limit(rps), burst: burst, ttl: ttl, clients: map[string]*ipClient{}}
+	go l.janitor()
+	return l
+}
+
+func (l *ipLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &ipClient{lim: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.lim
+}
+
+func (l *ipLimiter) allow(_ context.Context, ip string) (bool, time.Duration) {
+	res := l.get(ip).Reserve()
+	if d := res.Delay(); d > 0 {
+		res.Cancel()
+		return false, d
+	}
+	return true, 0
+}
+
+func (l *ipLimiter) janitor() {
+	for range time.Tick(l.ttl) {
+		cutoff := time.Now().Add(-l.ttl)
+		l.mu.Lock()
+		for ip, c := range l.clients {
+			if c.lastSeen.Before(cutoff) {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// redisLimiter is a fixed-window limiter shared by every instance through
+// Redis: at most limit requests per client IP per window. It fails open, so
+// a Redis outage disables limiting rather than the API.
+type redisLimiter struct {
+	limit  int
+	window time.Duration
+}
+
+// rateLimitScript counts a request and starts the window on the first one,
+// atomically so a crash between INCR and PEXPIRE can't leave an immortal key.
+var rateLimitScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return {n, redis.call('PTTL', KEYS[1])}
+`)
+
+func (l *redisLimiter) allow(ctx context.Context, ip string) (bool, time.Duration) {
+	// rdb is nil if Redis was unreachable at startup
+	if rdb == nil || !redisBreaker.allow() {
+		return true, 0
+	}
+	res, err := rateLimitScript.Run(ctx, rdb, []string{"ratelimit:" + ip}, l.window.Milliseconds()).Int64Slice()
+	if err != nil {
+		slog.WarnContext(ctx, "redis rate limit failed, allowing request", "err", err)
+		redisBreaker.failure()
+		return true, 0
+	}
+	redisBreaker.success()
+	if res[0] <= int64(l.limit) {
+		return true, 0
+	}
+	return false, time.Duration(max(res[1], 0)) * time.Millisecond
+}
+
+// trustedProxies are the peers whose X-Forwarded-For is believed
+// (TRUSTED_PROXIES, comma-separated IPs or CIDRs); empty means none.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a TRUSTED_PROXIES list.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			a, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func trustedProxy(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address: the socket peer, unless that is a
+// trusted proxy. X-Forwarded-For is then read from the right, each trusted
+// hop appending the address it saw, and the first untrusted entry is the
+// client. The entries further left are whatever the client sent, so they
+// are never used as the key; otherwise a client could pick a new bucket
+// on every request.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// withRateLimit rejects requests over the per-IP rate with 429 and a
+// Retry-After hint. Health probes are never limited.
+func withRateLimit(l rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, d := l.allow(r.Context(), clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(d.Seconds())))))
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
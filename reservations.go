@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// availableStockExpr is a product's stock less its active reservations, as
+// a select-list or WHERE expression over products.
+const availableStockExpr = `GREATEST(stock - (SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r WHERE r.product_id = products.id AND r.expires_at > now()), 0)::int`
+
+var (
+	// reservationTTL is how long a hold lasts when the request doesn't say
+	// (RESERVATION_TTL).
+	reservationTTL = 15 * time.Minute
+	// maxReservationTTL caps ttlSeconds.
+	maxReservationTTL = 24 * time.Hour
+)
+
+// Reservation holds Quantity units of a product until ExpiresAt. Expiry is
+// checked when stock is read, so a lapsed hold frees its units at once; the
+// sweeper only deletes the rows.
+type Reservation struct {
+	ID        string `json:"id"`
+	ProductID string `json:"productId"`
+	Quantity  int    `json:"quantity"`
+	ExpiresAt string `json:"expiresAt"`
+	CreatedAt string `json:"created_at"`
+}
+
+type reserveBody struct {
+	Quantity   int  `json:"quantity"`
+	TTLSeconds *int `json:"ttlSeconds"`
+}
+
+// reserveProduct serves POST /products/:id/reserve. The product row is
+// locked while the active holds are summed, so concurrent reservations and
+// purchases can't together take more than the stock.
+func reserveProduct(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var body reserveBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	errs := fieldErrors{}
+	if body.Quantity <= 0 || body.Quantity > maxQuantity {
+		errs["quantity"] = quantityInvalid
+	}
+	ttl := reservationTTL
+	if body.TTLSeconds != nil {
+		ttl = time.Duration(*body.TTLSeconds) * time.Second
+		if ttl <= 0 || ttl > maxReservationTTL {
+			errs["ttlSeconds"] = "must be between 1 and " + strconv.Itoa(int(maxReservationTTL.Seconds()))
+		}
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	res := Reservation{ID: uuid.NewString(), ProductID: id, Quantity: body.Quantity}
+	available := 0
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx,
+			`SELECT `+availableStockExpr+` FROM products WHERE id = $1::uuid AND deleted_at IS NULL FOR UPDATE`, id,
+		).Scan(&available); err != nil {
+			return err
+		}
+		if available < body.Quantity {
+			return errInsufficientStock
+		}
+		var expires, created time.Time
+		if err := tx.QueryRow(ctx,
+			`INSERT INTO reservations(id, product_id, quantity, expires_at)
+			 VALUES($1, $2::uuid, $3, now() + $4 * interval '1 millisecond') RETURNING expires_at, created_at`,
+			res.ID, id, body.Quantity, ttl.Milliseconds(),
+		).Scan(&expires, &created); err != nil {
+			return err
+		}
+		res.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		res.CreatedAt = created.Format(time.RFC3339)
+		return nil
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if errors.Is(err, errInsufficientStock) {
+		writeError(w, http.StatusConflict, codeInsufficientStock, "insufficient stock: "+strconv.Itoa(available)+" available")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	invalidateProducts(ctx, eventUpdated, id)
+	writeJSON(w, http.StatusCreated, res)
+}
+
+var (
+	errInsufficientStock = errors.New("insufficient stock")
+	errReservationGone   = errors.New("reservation gone")
+)
+
+// reservationItemHandler routes POST /reservations/:id/confirm and
+// /reservations/:id/cancel.
+func reservationItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/reservations/"), "/")
+	switch {
+	case action != "confirm" && action != "cancel":
+		notFound(w, r)
+	case r.Method != http.MethodPost:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	case uuid.Validate(id) != nil:
+		writeError(w, http.StatusNotFound, codeNotFound, "reservation not found")
+	case action == "confirm":
+		confirmReservation(w, r, id)
+	default:
+		cancelReservation(w, r, id)
+	}
+}
+
+// confirmReservation turns a hold into a purchase: the held units leave
+// stock and the reservation is removed in the same transaction.
+func confirmReservation(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var productID string
+	var quantity int
+	var active bool
+	err := db.QueryRow(ctx,
+		`SELECT product_id, quantity, expires_at > now() FROM reservations WHERE id = $1::uuid`, id,
+	).Scan(&productID, &quantity, &active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "reservation not found")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if !active {
+		writeError(w, http.StatusConflict, codeConflict, "reservation has expired")
+		return
+	}
+
+	p, err := updateWithAuditTx(ctx, productID, auditPurchase,
+		func(ctx context.Context, tx pgx.Tx, p *Product) error {
+			tag, err := tx.Exec(ctx, `DELETE FROM reservations WHERE id = $1::uuid AND expires_at > now()`, id)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() == 0 {
+				return errReservationGone
+			}
+			// the hold is gone, so what it covered is no longer subtracted
+			p.AvailableStock = min(p.AvailableStock+quantity, p.Stock)
+			return nil
+		},
+		`UPDATE products SET stock = stock - $2, version = version + 1, updated_at = now() WHERE id = $1::uuid AND deleted_at IS NULL AND stock >= $2`,
+		productID, quantity,
+	)
+	switch {
+	case errors.Is(err, errReservationGone):
+		// confirmed, cancelled or expired since it was read
+		writeError(w, http.StatusConflict, codeConflict, "reservation is no longer active")
+		return
+	case errors.Is(err, errProductMissing) || (errors.Is(err, pgx.ErrNoRows) && productDeleted(ctx, productID)):
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case errors.Is(err, pgx.ErrNoRows):
+		// stock was set below the hold since it was taken
+		writeError(w, http.StatusConflict, codeInsufficientStock, "insufficient stock")
+		return
+	case err != nil:
+		writeDBError(w, err, "db error")
+		return
+	}
+	invalidateProduct(ctx, eventUpdated, p)
+	writeJSON(w, http.StatusOK, map[string]any{"id": p.ID, "stock": p.Stock, "availableStock": p.AvailableStock})
+}
+
+// cancelReservation frees a hold. Expired holds are already free and
+// answer 404 like unknown ones.
+func cancelReservation(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var productID string
+	err := db.QueryRow(ctx,
+		`DELETE FROM reservations WHERE id = $1::uuid AND expires_at > now() RETURNING product_id`, id,
+	).Scan(&productID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "reservation not found")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	invalidateProducts(ctx, eventUpdated, productID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sweepReservations deletes expired holds every interval until ctx ends.
+// Their units were freed when they expired; this keeps the table small and
+// tells caches and streams that those products' availableStock went up.
+func sweepReservations(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rows, err := db.Query(ctx, `DELETE FROM reservations WHERE expires_at <= now() RETURNING product_id`)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("reservation sweep failed", "err", err)
+			}
+			continue
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("reservation sweep failed", "err", err)
+			}
+			continue
+		}
+		if len(ids) > 0 {
+			slices.Sort(ids)
+			invalidateProducts(ctx, eventUpdated, slices.Compact(ids)...)
+		}
+	}
+}
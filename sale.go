@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	salePriceInvalid = "must be > 0 and less than priceCents"
+	saleRangeInvalid = "must be after saleStartsAt"
+	timestampInvalid = "must be an RFC 3339 timestamp"
+)
+
+// normalizeTimestamp parses an RFC 3339 timestamp from a request body and
+// returns it in UTC, the form stored and echoed back. It returns ok=false if
+// s doesn't parse.
+func normalizeTimestamp(s string) (string, bool) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", false
+	}
+	return t.UTC().Format(time.RFC3339), true
+}
+
+// validateSaleWindow normalizes the sale bounds of a body in place and adds
+// their errors to errs. Nil and "" (PATCH's "clear it") bounds are left
+// alone.
+func validateSaleWindow(errs fieldErrors, starts, ends **string) {
+	valid := true
+	for field, v := range map[string]**string{"saleStartsAt": starts, "saleEndsAt": ends} {
+		if *v == nil || **v == "" {
+			continue
+		}
+		if s, ok := normalizeTimestamp(**v); ok {
+			*v = &s
+		} else {
+			errs[field] = timestampInvalid
+			valid = false
+		}
+	}
+	if !valid || *starts == nil || *ends == nil || **starts == "" || **ends == "" {
+		return
+	}
+	// RFC 3339 in UTC sorts as text
+	if **ends <= **starts {
+		errs["saleEndsAt"] = saleRangeInvalid
+	}
+}
+
+// saleActive reports whether p's sale price applies at now: it has one, the
+// sale has started (or has no start) and has not ended (or has no end).
+func saleActive(p Product, now time.Time) bool {
+	if p.SalePriceCents == nil {
+		return false
+	}
+	if p.SaleStartsAt != nil {
+		if t, err := time.Parse(time.RFC3339, *p.SaleStartsAt); err == nil && now.Before(t) {
+			return false
+		}
+	}
+	if p.SaleEndsAt != nil {
+		if t, err := time.Parse(time.RFC3339, *p.SaleEndsAt); err == nil && !now.Before(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// setEffectivePrice fills in EffectivePriceCents as of now. Cached lists
+// keep the value they were rendered with, so it can lag a sale boundary by
+// up to the cache TTL.
+func (p *Product) setEffectivePrice(now time.Time) {
+	p.EffectivePriceCents = p.PriceCents
+	if saleActive(*p, now) {
+		p.EffectivePriceCents = *p.SalePriceCents
+	}
+}
+
+// saleViolation maps a failed sale CHECK constraint (a PATCH can pair a new
+// price with the stored sale price, or a new end with the stored start) to
+// field errors. It returns nil for any other error.
+func saleViolation(err error) fieldErrors {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23514" {
+		return nil
+	}
+	switch pgErr.ConstraintName {
+	case "products_sale_price_check":
+		return fieldErrors{"salePriceCents": salePriceInvalid}
+	case "products_sale_range_check":
+		return fieldErrors{"saleEndsAt": saleRangeInvalid}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// skuRequired makes sku mandatory on create and PUT (SKU_REQUIRED=true).
+var skuRequired bool
+
+const maxSKULength = 64
+
+// skuPattern is alphanumeric runs separated by single dashes, e.g. AB-1234-X.
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+// normalizeSKU upper-cases a SKU so lookups are case-insensitive. It returns
+// a validation message if s is not a valid SKU.
+func normalizeSKU(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if len(s) > maxSKULength || !skuPattern.MatchString(s) {
+		return "", "must be letters and digits separated by single dashes, at most 64 characters"
+	}
+	return strings.ToUpper(s), ""
+}
+
+// getProductBySKU serves GET /products/by-sku/:sku.
+func getProductBySKU(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	sku, msg := normalizeSKU(strings.TrimPrefix(r.URL.Path, "/products/by-sku/"))
+	if msg != "" {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "invalid sku")
+		return
+	}
+	p, err := scanProduct(db.QueryRow(r.Context(),
+		`SELECT `+productColumns+` FROM products`+productJoins+` WHERE sku = $1 AND deleted_at IS NULL`, sku,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	setProductValidators(w, p)
+	writeJSON(w, http.StatusOK, p)
+}
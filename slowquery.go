@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// slowQueryThreshold is how long a query may take before it is logged as
+// slow (SLOW_QUERY_THRESHOLD); 0 turns the logging off.
+var slowQueryThreshold = 500 * time.Millisecond
+
+// slowQueryTracer times every query run through the pool and logs those
+// over slowQueryThreshold. A query's time runs until its rows are closed, so
+// it includes reading them. It wraps pgxTracer when tracing is enabled,
+// since a pool takes a single tracer.
+type slowQueryTracer struct {
+	next *pgxTracer // nil when tracing is off
+}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	at  time.Time
+	sql string
+}
+
+func (t slowQueryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if t.next != nil {
+		ctx = t.next.TraceQueryStart(ctx, conn, data)
+	}
+	return context.WithValue(ctx, queryStartKey{}, queryStart{time.Now(), data.SQL})
+}
+
+func (t slowQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if s, ok := ctx.Value(queryStartKey{}).(queryStart); ok {
+		if elapsed := time.Since(s.at); elapsed >= slowQueryThreshold {
+			slowQueries.Inc()
+			slog.WarnContext(ctx, "slow query", "query", queryName(s.sql), "elapsed", elapsed, "err", data.Err)
+		}
+	}
+	if t.next != nil {
+		t.next.TraceQueryEnd(ctx, conn, data)
+	}
+}
+
+func (t slowQueryTracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	if t.next != nil {
+		return t.next.TraceBatchStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (t slowQueryTracer) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	if t.next != nil {
+		t.next.TraceBatchQuery(ctx, conn, data)
+	}
+}
+
+func (t slowQueryTracer) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	if t.next != nil {
+		t.next.TraceBatchEnd(ctx, conn, data)
+	}
+}
+
+func (t slowQueryTracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	if t.next != nil {
+		return t.next.TraceCopyFromStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (t slowQueryTracer) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	if t.next != nil {
+		t.next.TraceCopyFromEnd(ctx, conn, data)
+	}
+}
+
+// maxQueryNameLength caps the SQL quoted in slow-query logs.
+const maxQueryNameLength = 200
+
+// queryName identifies a query in logs: its SQL on one line, cut short.
+// Queries are parameterised, so no values leak into it.
+func queryName(sql string) string {
+	s := strings.Join(strings.Fields(sql), " ")
+	if len(s) > maxQueryNameLength {
+		s = s[:maxQueryNameLength] + "..."
+	}
+	return s
+}
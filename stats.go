@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// statsCacheTTL bounds how stale GET /stats can be between invalidations.
+const statsCacheTTL = 30 * time.Second
+
+// Stats summarises the live catalogue. Money can't be added across
+// currencies, so inventory value and average price are per currency, like
+// cart totals.
+type Stats struct {
+	ProductCount        int            `json:"productCount"`
+	OutOfStockCount     int            `json:"outOfStockCount"`
+	InventoryValueCents map[string]int `json:"inventoryValueCents"` // sum of priceCents * stock
+	AveragePriceCents   map[string]int `json:"averagePriceCents"`   // rounded to the cent
+}
+
+// getStats serves GET /stats from one aggregate query, grouped by currency.
+// Like the count, its cache key is a listCacheKey, so product changes drop it.
+func getStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+	s, key, ok := listCacheGet(ctx, "stats")
+	if ok {
+		productsCache.WithLabelValues("hit").Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(s))
+		return
+	}
+	if rdb != nil {
+		productsCache.WithLabelValues("miss").Inc()
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT currency, count(*), count(*) FILTER (WHERE stock = 0),
+		        COALESCE(sum(price_cents::bigint * stock), 0)::bigint, round(avg(price_cents))::bigint
+		 FROM products WHERE deleted_at IS NULL GROUP BY currency`,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	st := Stats{InventoryValueCents: map[string]int{}, AveragePriceCents: map[string]int{}}
+	for rows.Next() {
+		var currency string
+		var n, out, value, avg int
+		if err := rows.Scan(&currency, &n, &out, &value, &avg); err != nil {
+			rows.Close()
+			writeDBError(w, err, "db error")
+			return
+		}
+		st.ProductCount += n
+		st.OutOfStockCount += out
+		st.InventoryValueCents[currency] = value
+		st.AveragePriceCents[currency] = avg
+	}
+	if err := rows.Err(); err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+
+	b, _ := json.Marshal(st)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	if err := listCacheSet(ctx, key, b, statsCacheTTL); err != nil {
+		productsCachePopulateFailures.Inc()
+	}
+}
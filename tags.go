@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// normalizeTags trims and lower-cases tags, dropping duplicates (so "Sale"
+// and "sale " in one request are one tag), and sorts them the way reads
+// return them. It returns a validation message if a tag is unusable.
+func normalizeTags(tags []string) ([]string, string) {
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+			return nil, "must not contain empty tags"
+		case len(t) > maxTagLength:
+			return nil, fmt.Sprintf("tags must be at most %d bytes", maxTagLength)
+		}
+		out = append(out, t)
+	}
+	slices.Sort(out)
+	out = slices.Compact(out)
+	if len(out) > maxTags {
+		return nil, fmt.Sprintf("at most %d tags", maxTags)
+	}
+	return out, ""
+}
+
+const (
+	upsertTagsSQL = `INSERT INTO tags(name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING`
+	linkTagsSQL   = `INSERT INTO product_tags(product_id, tag_id) SELECT $1::uuid, id FROM tags WHERE name = ANY($2::text[])`
+)
+
+// setProductTags replaces the tags of product id with the normalized tags,
+// creating tags that don't exist yet.
+func setProductTags(ctx context.Context, tx pgx.Tx, id string, tags []string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM product_tags WHERE product_id = $1::uuid`, id); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, upsertTagsSQL, tags); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, linkTagsSQL, id, tags)
+	return err
+}
+
+// tagsUpdater is the updateWithAuditTx step that replaces a product's tags
+// with the normalized tags, or nil when the request left tags alone.
+func tagsUpdater(tags []string) func(context.Context, pgx.Tx, *Product) error {
+	if tags == nil {
+		return nil
+	}
+	return func(ctx context.Context, tx pgx.Tx, p *Product) error {
+		if err := setProductTags(ctx, tx, p.ID, tags); err != nil {
+			return err
+		}
+		p.Tags = tags
+		return nil
+	}
+}
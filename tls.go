@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsVersions are the TLS_MIN_VERSION values accepted.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfigFromEnv builds the server's TLS config: nil (plain HTTP) unless
+// TLS_CERT_FILE and TLS_KEY_FILE are both set. TLS_MIN_VERSION is 1.2 or 1.3
+// (default 1.2). With TLS_CLIENT_CA_FILE, clients must present a
+// certificate signed by one of its CAs (mTLS). The files are loaded now so
+// a bad path or key fails startup rather than the first handshake.
+func tlsConfigFromEnv() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("set both TLS_CERT_FILE and TLS_KEY_FILE, or neither")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := os.Getenv("TLS_MIN_VERSION")
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	v, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("TLS_MIN_VERSION %q must be 1.2 or 1.3", minVersion)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: v}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in TLS_CLIENT_CA_FILE %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
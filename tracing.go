@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer delegates to whatever provider setupTracing installs; until then
+// (and when tracing is off) it is a no-op.
+var tracer = otel.Tracer("store-svc-go")
+
+// tracingEnabled is set by setupTracing when an OTLP endpoint is configured.
+var tracingEnabled bool
+
+// setupTracing installs an OTLP/HTTP exporter when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or its traces-specific variant) is set; the exporter reads the rest of
+// the standard OTEL_* env. The returned func flushes pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("store-svc")))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+	return tp.Shutdown, nil
+}
+
+// withTracing starts a server span per request, continuing any trace in the
+// incoming headers. Spans are named after the matched mux pattern.
+func withTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return r.Method + " " + pattern
+		}
+		return r.Method
+	}))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// --- postgres ---
+
+// pgxTracer creates a client span around every query, batch and COPY run
+// through the pool.
+type pgxTracer struct{}
+
+var dbAttrs = trace.WithAttributes(semconv.DBSystemPostgreSQL)
+
+func (pgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = tracer.Start(ctx, "db.query", trace.WithSpanKind(trace.SpanKindClient), dbAttrs,
+		trace.WithAttributes(semconv.DBQueryText(data.SQL)))
+	return ctx
+}
+
+func (pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+func (pgxTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx, _ = tracer.Start(ctx, "db.batch", trace.WithSpanKind(trace.SpanKindClient), dbAttrs,
+		trace.WithAttributes(attribute.Int("db.batch.size", data.Batch.Len())))
+	return ctx
+}
+
+func (pgxTracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	if data.Err != nil {
+		trace.SpanFromContext(ctx).RecordError(data.Err)
+	}
+}
+
+func (pgxTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+func (pgxTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	ctx, _ = tracer.Start(ctx, "db.copy", trace.WithSpanKind(trace.SpanKindClient), dbAttrs,
+		trace.WithAttributes(semconv.DBCollectionName(data.TableName.Sanitize())))
+	return ctx
+}
+
+func (pgxTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+// --- redis ---
+
+// redisTracingHook creates a client span around every Redis command.
+type redisTracingHook struct{}
+
+func (redisTracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, span := tracer.Start(ctx, "redis.dial", trace.WithSpanKind(trace.SpanKindClient))
+		conn, err := next(ctx, network, addr)
+		endSpan(span, err)
+		return conn, err
+	}
+}
+
+func (redisTracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := tracer.Start(ctx, "redis."+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemRedis))
+		err := next(ctx, cmd)
+		if errors.Is(err, redis.Nil) {
+			endSpan(span, nil) // a miss, not a failure
+			return err
+		}
+		endSpan(span, err)
+		return err
+	}
+}
+
+func (redisTracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := tracer.Start(ctx, "redis.pipeline", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemRedis, attribute.Int("db.redis.commands", len(cmds))))
+		err := next(ctx, cmds)
+		endSpan(span, err)
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version and commit identify the build. Release builds set them with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD)"
+//
+// otherwise commit falls back to the VCS revision the toolchain embedded.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// startTime is when main started, for uptime.
+var startTime time.Time
+
+// buildCommit returns commit, or the embedded vcs.revision (with "-dirty"
+// for modified trees) when it wasn't set at link time.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	rev, dirty := "unknown", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if dirty {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// handleVersion serves GET /version, which says which build is running and
+// for how long. /health stays a bare liveness probe.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	up := time.Since(startTime)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":       version,
+		"commit":        buildCommit(),
+		"goVersion":     runtime.Version(),
+		"startedAt":     startTime.UTC().Format(time.RFC3339),
+		"uptimeSeconds": int64(up.Seconds()),
+	})
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// signatureHeader carries the hex HMAC-SHA256 of a webhook body, keyed with
+// the webhook's secret, as "sha256=<hex>".
+const signatureHeader = "X-Signature-256"
+
+// signPayload returns the signatureHeader value for body.
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook POSTs body as JSON to url, signed with secret if it is set.
+// Any non-2xx response is an error.
+func postWebhook(ctx context.Context, client *http.Client, url string, secret, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "store-svc-webhook")
+	if len(secret) > 0 {
+		req.Header.Set(signatureHeader, signPayload(secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// lowStockEvent is the JSON body POSTed to LOW_STOCK_WEBHOOK_URL.
+type lowStockEvent struct {
+	Type      string  `json:"type"` // always "product.low_stock"
+	ProductID string  `json:"productId"`
+	Name      string  `json:"name"`
+	SKU       *string `json:"sku"`
+	Stock     int     `json:"stock"`
+	Threshold int     `json:"threshold"`
+	At        string  `json:"at"`
+}
+
+// lowStockHook delivers low-stock alerts; nil unless LOW_STOCK_WEBHOOK_URL
+// is set.
+var lowStockHook *lowStockNotifier
+
+// lowStockNotifier POSTs queued events from a single background goroutine,
+// so a slow or failing endpoint never holds up the request that triggered
+// the alert. Each event is tried up to attempts times with doubling delays;
+// events arriving while the queue is full are dropped and logged.
+type lowStockNotifier struct {
+	url      string
+	secret   []byte
+	client   *http.Client
+	attempts int
+	delay    time.Duration
+	queue    chan lowStockEvent
+}
+
+func newLowStockNotifier(url string, secret []byte, timeout time.Duration, attempts int) *lowStockNotifier {
+	n := &lowStockNotifier{
+		url:      url,
+		secret:   secret,
+		client:   &http.Client{Timeout: timeout},
+		attempts: max(attempts, 1),
+		delay:    time.Second,
+		queue:    make(chan lowStockEvent, 100),
+	}
+	go n.run()
+	return n
+}
+
+func (n *lowStockNotifier) run() {
+	for ev := range n.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			slog.Error("low stock webhook encode failed", "product_id", ev.ProductID, "err", err)
+			continue
+		}
+		err = retryBackoff(context.Background(), "low stock webhook", n.attempts, n.delay, func(ctx context.Context) error {
+			return postWebhook(ctx, n.client, n.url, n.secret, body)
+		})
+		if err != nil {
+			slog.Error("low stock webhook failed, giving up", "product_id", ev.ProductID, "attempts", n.attempts, "err", err)
+		}
+	}
+}
+
+// checkLowStock queues an alert if the change from old to p took stock from
+// at or above p's threshold to below it. It never blocks.
+func checkLowStock(old, p Product) {
+	if lowStockHook == nil || p.LowStockThreshold == nil {
+		return
+	}
+	t := *p.LowStockThreshold
+	if p.Stock >= old.Stock || old.Stock < t || p.Stock >= t {
+		return
+	}
+	ev := lowStockEvent{
+		Type:      "product.low_stock",
+		ProductID: p.ID,
+		Name:      p.Name,
+		SKU:       p.SKU,
+		Stock:     p.Stock,
+		Threshold: t,
+		At:        time.Now().UTC().Format(time.RFC3339),
+	}
+	select {
+	case lowStockHook.queue <- ev:
+	default:
+		slog.Warn("low stock webhook queue full, dropping alert", "product_id", p.ID)
+	}
+}
+
+// --- lifecycle webhooks ---
+
+// webhookEvents are the event types a subscription may ask for. The
+// queue_product_webhooks trigger maps audit actions onto them.
+var webhookEvents = []string{eventCreated, eventUpdated, eventDeleted}
+
+type webhookSubscription struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // only returned on creation
+	CreatedAt string   `json:"created_at"`
+}
+
+type webhookBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // defaults to every event
+	Secret string   `json:"secret"` // generated when omitted
+}
+
+func (b *webhookBody) validate() fieldErrors {
+	errs := fieldErrors{}
+	if !validHTTPURL(b.URL) {
+		errs["url"] = "must be an absolute http or https URL"
+	}
+	if len(b.Events) == 0 {
+		b.Events = slices.Clone(webhookEvents)
+	}
+	for _, e := range b.Events {
+		if !slices.Contains(webhookEvents, e) {
+			errs["events"] = "must be among " + strings.Join(webhookEvents, ", ")
+			break
+		}
+	}
+	slices.Sort(b.Events)
+	b.Events = slices.Compact(b.Events)
+	return errs
+}
+
+// webhooksHandler serves GET and POST /webhooks.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listWebhooks(w, r)
+	case http.MethodPost:
+		createWebhook(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// webhookItemHandler serves DELETE /webhooks/:id and GET
+// /webhooks/dead-letters.
+func webhookItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+	switch {
+	case id == "dead-letters" && r.Method == http.MethodGet:
+		listDeadLetters(w, r)
+	case id == "dead-letters" || r.Method != http.MethodDelete:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	case uuid.Validate(id) != nil:
+		writeError(w, http.StatusNotFound, codeNotFound, "webhook not found")
+	default:
+		deleteWebhook(w, r, id)
+	}
+}
+
+// listWebhooks returns every subscription, without secrets.
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(r.Context(), `SELECT id, url, events, created_at FROM webhook_subscriptions ORDER BY created_at, id`)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (webhookSubscription, error) {
+		var s webhookSubscription
+		var t time.Time
+		err := row.Scan(&s.ID, &s.URL, &s.Events, &t)
+		s.CreatedAt = t.Format(time.RFC3339)
+		return s, err
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createWebhook registers a subscription. The response is the only place the
+// secret is shown, so a generated one must be saved by the caller.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var body webhookBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if body.Secret == "" {
+		body.Secret = rand.Text()
+	}
+
+	createdAt := time.Now().UTC()
+	s := webhookSubscription{
+		ID:        uuid.New().String(),
+		URL:       body.URL,
+		Events:    body.Events,
+		Secret:    body.Secret,
+		CreatedAt: createdAt.Format(time.RFC3339),
+	}
+	_, err := db.Exec(r.Context(),
+		`INSERT INTO webhook_subscriptions(id, url, secret, events, created_at) VALUES($1, $2, $3, $4, $5)`,
+		s.ID, s.URL, s.Secret, s.Events, createdAt,
+	)
+	if err != nil {
+		writeDBError(w, err, "insert error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// deleteWebhook removes a subscription along with its pending and
+// dead-lettered deliveries.
+func deleteWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	tag, err := db.Exec(r.Context(), `DELETE FROM webhook_subscriptions WHERE id = $1::uuid`, id)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "webhook not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type deadLetter struct {
+	ID             int64  `json:"id"`
+	SubscriptionID string `json:"subscriptionId"`
+	Event          string `json:"event"`
+	EventID        int64  `json:"eventId"`
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"lastError"`
+	DeadAt         string `json:"deadAt"`
+}
+
+// listDeadLetters returns the newest 100 deliveries that ran out of retries.
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(r.Context(),
+		`SELECT id, subscription_id, event, audit_id, attempts, COALESCE(last_error, ''), dead_at
+		 FROM webhook_deliveries WHERE dead_at IS NOT NULL ORDER BY dead_at DESC, id DESC LIMIT 100`,
+	)
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (deadLetter, error) {
+		var d deadLetter
+		var t time.Time
+		err := row.Scan(&d.ID, &d.SubscriptionID, &d.Event, &d.EventID, &d.Attempts, &d.LastError, &t)
+		d.DeadAt = t.Format(time.RFC3339)
+		return d, err
+	})
+	if err != nil {
+		writeDBError(w, err, "db error")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// productEvent is the JSON body of a lifecycle webhook. ID is the audit
+// entry's id, so it is the same on every retry and receivers can use it to
+// drop duplicates.
+type productEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Timestamp string          `json:"timestamp"`
+	Product   json.RawMessage `json:"product"` // as it was deleted, for product.deleted
+}
+
+const (
+	webhookBatchSize = 20
+	maxWebhookDelay  = time.Hour
+)
+
+// webhookWorker delivers queued webhook_deliveries at least once. Any number
+// of instances may run one: a delivery is leased by pushing its
+// next_attempt_at past the request timeout, so a crash mid-delivery means
+// it is retried rather than lost. Failures back off exponentially from
+// baseDelay; after maxAttempts a delivery is dead-lettered.
+type webhookWorker struct {
+	client      *http.Client
+	interval    time.Duration
+	baseDelay   time.Duration
+	maxAttempts int
+}
+
+// run polls for due deliveries until ctx is done.
+func (wk *webhookWorker) run(ctx context.Context) {
+	t := time.NewTicker(wk.interval)
+	defer t.Stop()
+	for {
+		for {
+			n, err := wk.deliverDue(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("webhook poll failed", "err", err)
+			}
+			if n < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+type delivery struct {
+	id       int64
+	attempts int
+	url      string
+	secret   string
+	body     []byte
+}
+
+// deliverDue leases up to webhookBatchSize due deliveries, sends them
+// concurrently and records the outcomes. It returns how many it leased.
+func (wk *webhookWorker) deliverDue(ctx context.Context) (int, error) {
+	lease := wk.client.Timeout + 30*time.Second
+	rows, err := db.Query(ctx, `
+UPDATE webhook_deliveries d
+SET attempts = d.attempts + 1, next_attempt_at = now() + $2 * interval '1 millisecond'
+FROM webhook_subscriptions s, product_audit a
+WHERE s.id = d.subscription_id AND a.id = d.audit_id AND d.id IN (
+  SELECT id FROM webhook_deliveries WHERE dead_at IS NULL AND next_attempt_at <= now()
+  ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+RETURNING d.id, d.event, d.attempts, s.url, s.secret, a.id, a.at, COALESCE(a.new_value, a.old_value)`,
+		webhookBatchSize, lease.Milliseconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (delivery, error) {
+		var d delivery
+		var ev productEvent
+		var at time.Time
+		if err := row.Scan(&d.id, &ev.Type, &d.attempts, &d.url, &d.secret, &ev.ID, &at, &ev.Product); err != nil {
+			return d, err
+		}
+		ev.Timestamp = at.UTC().Format(time.RFC3339)
+		var err error
+		d.body, err = json.Marshal(ev)
+		return d, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range list {
+		wg.Go(func() { wk.deliver(ctx, d) })
+	}
+	wg.Wait()
+	return len(list), nil
+}
+
+// retryDelay is the backoff after the given failed attempt: baseDelay
+// doubled per earlier attempt, capped at maxWebhookDelay. The cap is
+// checked before shifting so a large baseDelay can't overflow negative.
+func (wk *webhookWorker) retryDelay(attempts int) time.Duration {
+	shift := min(max(attempts-1, 0), 30)
+	if wk.baseDelay > maxWebhookDelay>>shift {
+		return maxWebhookDelay
+	}
+	return wk.baseDelay << shift
+}
+
+// deliver sends d and records the outcome. If recording fails the lease
+// expires and d is sent again, which at-least-once allows.
+func (wk *webhookWorker) deliver(ctx context.Context, d delivery) {
+	sendErr := postWebhook(ctx, wk.client, d.url, []byte(d.secret), d.body)
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = db.Exec(ctx, `DELETE FROM webhook_deliveries WHERE id = $1`, d.id)
+	case d.attempts >= wk.maxAttempts:
+		slog.Error("webhook delivery dead-lettered", "delivery_id", d.id, "url", d.url, "attempts", d.attempts, "err", sendErr)
+		_, err = db.Exec(ctx, `UPDATE webhook_deliveries SET dead_at = now(), last_error = $2 WHERE id = $1`, d.id, sendErr.Error())
+	default:
+		delay := wk.retryDelay(d.attempts)
+		slog.Warn("webhook delivery failed, retrying", "delivery_id", d.id, "url", d.url, "attempt", d.attempts, "retry_in", delay, "err", sendErr)
+		_, err = db.Exec(ctx,
+			`UPDATE webhook_deliveries SET next_attempt_at = now() + $2 * interval '1 millisecond', last_error = $3 WHERE id = $1`,
+			d.id, delay.Milliseconds(), sendErr.Error(),
+		)
+	}
+	if err != nil && ctx.Err() == nil {
+		slog.Error("webhook delivery update failed", "delivery_id", d.id, "err", err)
+	}
+}
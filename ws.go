@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// wsWriteTimeout bounds each message and ping, so a stalled client is
+// dropped instead of pinning its goroutine.
+const wsWriteTimeout = 10 * time.Second
+
+// stockMessage is what /ws pushes for every product whose stock a change
+// reported.
+type stockMessage struct {
+	Type      string `json:"type"` // always "stock"
+	Event     string `json:"event"`
+	ProductID string `json:"productId"`
+	Stock     int    `json:"stock"`
+}
+
+// wsHandler serves /ws, a WebSocket that pushes stock changes from every
+// instance. Clients only listen; the read side just answers pings and
+// notices the close. At most max connections are open at once.
+type wsHandler struct {
+	accept    websocket.AcceptOptions
+	max       int64
+	conns     atomic.Int64
+	pingEvery time.Duration
+}
+
+// newWSHandler accepts connections from origins, the ALLOWED_ORIGINS
+// allowlist, or from any origin when it is nil, matching CORS.
+func newWSHandler(origins map[string]bool, maxConns int, pingEvery time.Duration) *wsHandler {
+	h := &wsHandler{max: int64(maxConns), pingEvery: pingEvery}
+	if origins == nil {
+		h.accept.InsecureSkipVerify = true
+	} else {
+		h.accept.OriginPatterns = slices.Sorted(maps.Keys(origins))
+	}
+	return h
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.conns.Add(1) > h.max {
+		h.conns.Add(-1)
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "too many websocket connections")
+		return
+	}
+	defer h.conns.Add(-1)
+
+	// the hijacked connection keeps the server's deadlines unless cleared
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	conn, err := websocket.Accept(w, r, &h.accept)
+	if err != nil {
+		slog.WarnContext(r.Context(), "websocket accept failed", "err", err)
+		return // Accept has written the response
+	}
+	defer conn.CloseNow()
+
+	ch, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+
+	// CloseRead's context ends when the client goes away or ctx does
+	ctx := conn.CloseRead(r.Context())
+	t := time.NewTicker(h.pingEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-ch:
+			if !ok {
+				// dropped for falling behind, or shutting down
+				conn.Close(websocket.StatusTryAgainLater, "stream ended, reconnect")
+				return
+			}
+			for _, id := range c.IDs {
+				stock, ok := c.Stock[id]
+				if !ok {
+					continue
+				}
+				if err := h.write(ctx, conn, stockMessage{Type: "stock", Event: c.Type, ProductID: id, Stock: stock}); err != nil {
+					return
+				}
+			}
+		case <-t.C:
+			pctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+			err := conn.Ping(pctx)
+			cancel()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *wsHandler) write(ctx context.Context, conn *websocket.Conn, m stockMessage) error {
+	b, _ := json.Marshal(m)
+	ctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+	return conn.Write(ctx, websocket.MessageText, b)
+}